@@ -1,14 +1,18 @@
 package dest
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
 	"golang.org/x/sys/unix"
 )
 
@@ -26,6 +30,27 @@ const (
 	unsetType = Type(-1) // Not a valid type.
 
 	defaultPerm = 0644
+
+	// maxRecordLen is the length beyond which a record is split into pieces
+	// when the Dest splits its input into records. A length-prefixed record
+	// this long is passed on unframed, in pieces.
+	maxRecordLen = 64 * 1024
+
+	// defaultQueueSize is the capacity of a queue that a Dest's overflow
+	// policy requires when the user did not size it.
+	defaultQueueSize = 1024 * 1024
+
+	// defaultSpillMax is the maximum size of a Dest's spill directory when
+	// the user did not specify one.
+	defaultSpillMax = 1024 * 1024 * 1024
+
+	// defaultFailback is how long a failover group waits before retrying
+	// members that outrank the one receiving data.
+	defaultFailback = 10 * time.Second
+
+	// defaultProbe is how long a Dest's open circuit waits before probing the
+	// Dest.
+	defaultProbe = 10 * time.Second
 )
 
 var typeNames = []string{
@@ -47,14 +72,52 @@ func init() {
 // Dest is a fully self-contained description of a data sink. Use the Open
 // method to acquire a corresponding writer for the Dest.
 type Dest struct {
-	Type        Type
-	ID          string
-	Perm        uint32
-	Args        []string
-	NonBlocking bool
-	BufSize     int
-	Append      bool
-	Create      bool
+	Type      Type
+	ID        string
+	Perm      uint32
+	Args      []string
+	Overflow  output.Overflow
+	BufSize   int
+	Append    bool
+	Create    bool
+	Stream    string
+	Framing   *record.Framing        // How output is split into records; nil to write it as it arrives.
+	Marker    string                 // Format of in-band drop markers; empty for none.
+	Seq       bool                   // Prefix each record with a sequence number.
+	QueueSize int                    // Capacity of the Dest's queue in bytes; 0 for none.
+	Spill     string                 // Directory of the Dest's disk queue; empty for none.
+	SpillMax  int                    // Capacity of the Dest's disk queue in bytes.
+	Timeout   time.Duration          // Longest a write may take; 0 for no limit.
+	Optional  bool                   // Detach the Dest on error rather than failing.
+	Reconnect bool                   // Open a fifo only while it has a reader.
+	Group     string                 // Failover group the Dest belongs to; empty for none.
+	Priority  int                    // Rank within the group; lower goes first.
+	Failback  time.Duration          // How long a group waits before retrying higher-priority members.
+	Breaker   int                    // Consecutive errors that open the Dest's circuit; 0 for no breaker.
+	Probe     time.Duration          // How long an open circuit waits before probing the Dest.
+	ByteRate  int                    // Bytes per second; 0 for no limit.
+	LineRate  int                    // Records per second; 0 for no limit.
+	Limit     output.RateLimit       // What to do with data over the rate limits.
+	Sample    *output.Sampling       // Which records to forward; nil for all.
+	SampleKey *regexp.Regexp         // Key records are sampled by; nil for none.
+	Include   []*regexp.Regexp       // Forward only records matching one of these.
+	Exclude   []*regexp.Regexp       // Forward no records matching any of these.
+	Redact    []output.RedactRule    // Content to redact.
+	RedactKey []byte                 // HMAC key for redacted content; nil to mask it.
+	Timestamp output.TimestampFormat // Format of the timestamp prefixing each record.
+	Prefix    string                 // Text prefixing each record; empty for none.
+	Format    output.Format          // How records are encoded.
+	Fields    []output.Field         // Static fields of JSON envelopes.
+	Where     []*output.Cond         // Forward only JSON records satisfying all of these.
+	Invalid   bool                   // Forward only records that are not JSON objects.
+	InvalidTo string                 // Id of the output that receives records that are not JSON objects; empty for none.
+	OutFormat *output.OutFormat      // Format to render structured records in; nil to leave them.
+	Multiline *output.Multiline      // How to fold continuation lines; nil to leave them.
+
+	// opened is set once the Dest has been opened. A Dest that is reopened
+	// after a failure, by a circuit breaker or a failover group, must not
+	// lose what was written to it before.
+	opened bool
 }
 
 // makeDest builds a default-initialized Dest struct. The result is not usable
@@ -62,9 +125,270 @@ type Dest struct {
 // destination specifier string.
 func makeDest() Dest {
 	return Dest{
-		Type: unsetType,
-		Perm: defaultPerm,
+		Type:     unsetType,
+		Perm:     defaultPerm,
+		SpillMax: defaultSpillMax,
+		Failback: defaultFailback,
+		Probe:    defaultProbe,
+	}
+}
+
+// Accepts reports whether the Dest receives data from the named input stream.
+// A Dest without a stream restriction accepts every stream.
+func (d *Dest) Accepts(stream string) bool {
+	return d.Stream == "" || d.Stream == stream
+}
+
+// Name returns a short description of the Dest for use in messages.
+func (d *Dest) Name() string {
+	return fmt.Sprintf("%s:%s", typeNames[d.Type], d.ID)
+}
+
+// NewWriter builds a record writer for the Dest. Records pass through a
+// chain of writers, in this order: framing, multiline folding, filters
+// (include and exclude, invalid, where), sampling, rewriting (redaction,
+// conversion, sequence numbers, stamps, JSON envelopes), the queue, the rate
+// limit, and the write timeout, before reaching the writer returned by Open.
+// Stages the Dest doesn't ask for are left out. A circuit breaker, then the
+// handling of optional Dests, wrap the whole chain.
+func (d *Dest) NewWriter() (record.Writer, error) {
+	var rw record.Writer
+	var c io.Closer
+	if d.Breaker > 0 {
+		bw, err := output.NewBreakerWriter(d.Name(), d.newWriter, d.Breaker, d.Probe)
+		if err != nil {
+			return nil, err
+		}
+		rw, c = bw, bw
+	} else {
+		var err error
+		rw, c, err = d.newWriter()
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	if d.Optional {
+		rw = output.NewOptionalWriter(rw, d.Name(), c)
+	}
+
+	return rw, nil
+}
+
+// newWriter builds the Dest's record writer, less the handling of optional
+// Dests. It also returns a closer that releases the writer returned by Open
+// and the goroutines and files of the chain built on it, or nil if there is
+// nothing to release. A circuit breaker or a failover group closes the chain
+// before building a new one.
+func (d *Dest) newWriter() (record.Writer, io.Closer, error) {
+	w, err := d.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The stages of the chain that run goroutines or hold files are closed
+	// along with the writer returned by Open.
+	var tw *output.TimeoutWriter
+	var qw *output.QueueWriter
+
+	rw := record.NewStreamWriter(w)
+	if d.Timeout > 0 {
+		tw = output.NewTimeoutWriter(rw, d.Name(), d.Timeout, d.timeoutMode())
+		if d.Marker != "" {
+			tw.SetMarker(d.markerFunc())
+		}
+		rw = tw
+	}
+	if d.ByteRate > 0 || d.LineRate > 0 {
+		// The rate limit applies as data leaves the queue, so that a delay
+		// only holds up the rest of rex once the queue is full.
+		rl := output.NewRateWriter(rw, d.ByteRate, d.LineRate, d.Limit, d.Framing != nil)
+		if d.Marker != "" {
+			rl.SetMarker(d.markerFunc())
+		}
+		rw = rl
+	}
+	if qs := d.queueSize(); qs > 0 {
+		qw = output.NewQueueWriter(rw, qs, d.Overflow)
+		if d.Marker != "" {
+			qw.SetMarker(d.markerFunc())
+		}
+		rw = qw
+		if d.Spill != "" {
+			err := qw.SetSpill(d.Spill, int64(d.SpillMax))
+			if err != nil {
+				d.closer(w, tw, qw).Close()
+				return nil, nil, err
+			}
+		}
+	}
+	if d.Format == output.FormatJSON {
+		jw, err := output.NewJSONWriter(rw, d.Fields, d.delim())
+		if err != nil {
+			d.closer(w, tw, qw).Close()
+			return nil, nil, err
+		}
+		rw = jw
+	}
+	if d.Timestamp != output.TimestampNone || d.Prefix != "" {
+		rw = output.NewStampWriter(rw, d.Timestamp, d.Prefix)
+	}
+	if d.Seq {
+		rw = output.NewSeqWriter(rw)
+	}
+	if d.OutFormat != nil {
+		rw = output.NewConvertWriter(rw, *d.OutFormat)
+	}
+	if d.Redact != nil {
+		rw = output.NewRedactWriter(rw, d.Redact, d.RedactKey)
+	}
+	if d.Sample != nil {
+		rw = output.NewSampleWriter(rw, *d.Sample, d.SampleKey)
+	}
+	if d.Where != nil {
+		rw = output.NewWhereWriter(rw, d.Where)
+	}
+	if d.Invalid {
+		rw = output.NewInvalidWriter(rw)
+	}
+	if d.Include != nil || d.Exclude != nil {
+		rw = output.NewFilterWriter(rw, d.Include, d.Exclude)
+	}
+	if d.Multiline != nil {
+		rw = output.NewMultilineWriter(rw, *d.Multiline)
+	}
+	if d.Framing != nil {
+		rw = record.NewFrameWriter(rw, d.Framing, maxRecordLen)
+	}
+
+	// Give callers access to the queue behind the rest of the chain.
+	if qw != nil {
+		rw = output.NewQueuedWriter(rw, qw)
+	}
+
+	return rw, d.closer(w, tw, qw), nil
+}
+
+// closer returns a closer that releases the writer returned by Open, w, along
+// with the timeout and queue stages of the chain built on it, either of which
+// may be nil. The queue stops draining first, and the timeout's goroutine
+// exits last, once closing w has failed any write hung in it. It returns nil
+// if there is nothing to close.
+func (d *Dest) closer(w io.Writer, tw *output.TimeoutWriter, qw *output.QueueWriter) io.Closer {
+	var cs closers
+	if qw != nil {
+		cs = append(cs, qw)
+	}
+
+	// rex doesn't own the descriptors that fd Dests write to, such as its
+	// stdout, so it never closes them.
+	if c, ok := w.(io.Closer); ok && d.Type != TypeFD {
+		cs = append(cs, c)
+	}
+
+	if tw != nil {
+		cs = append(cs, tw)
+	}
+
+	if cs == nil {
+		return nil
+	}
+	return cs
+}
+
+// closers is an io.Closer that closes each of a series of io.Closers in turn.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var errs []error
+	for _, c := range cs {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// timeoutMode returns what the Dest does with its data while a write is
+// taking too long. Data waiting in a spill directory is not lost, so there is
+// no need to discard it: the writer waits, holding up only the goroutine that
+// drains the queue. Without a queue, waiting would hold up the rest of rex, so
+// the data is discarded instead. A member of a failover group fails, so that
+// its data goes to the next member, and so does a Dest with a circuit
+// breaker, so that timeouts count against it.
+func (d *Dest) timeoutMode() output.TimeoutMode {
+	switch {
+	case d.Group != "", d.Breaker > 0:
+		return output.TimeoutFail
+
+	case d.Overflow == output.OverflowSpill && d.queueSize() > 0:
+		return output.TimeoutWait
+
+	default:
+		return output.TimeoutDrop
+	}
+}
+
+// queueSize returns the capacity of the Dest's queue, or 0 if it has none.
+// Dropping the oldest data requires a queue to drop it from, and data only
+// spills to disk once the in-memory queue is full. Dropping the newest data
+// needs no queue if the kernel can discard whatever doesn't fit in the file
+// descriptor's buffer.
+func (d *Dest) queueSize() int {
+	if d.QueueSize > 0 {
+		return d.QueueSize
+	}
+
+	switch d.Overflow {
+	case output.OverflowDropOldest, output.OverflowSpill:
+		return defaultQueueSize
+
+	case output.OverflowDropNewest:
+		if !d.kernelDrops() {
+			return defaultQueueSize
+		}
+	}
+
+	return 0
+}
+
+// kernelDrops reports whether a nonblocking file descriptor for the Dest
+// would discard data that doesn't fit. That requires a pipe, a socket or a
+// character device, such as a terminal: writes to a regular file ignore
+// O_NONBLOCK.
+func (d *Dest) kernelDrops() bool {
+	var st unix.Stat_t
+	var err error
+	switch d.Type {
+	case TypeFD:
+		fd, convErr := strconv.Atoi(d.ID)
+		if convErr != nil {
+			return false
+		}
+		err = unix.Fstat(fd, &st)
+
+	case TypeFile:
+		err = unix.Stat(d.ID, &st)
+
+	default:
+		// Fifos and process stdins are pipes.
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFIFO, unix.S_IFSOCK, unix.S_IFCHR:
+		return true
+	default:
+		return false
+	}
+}
+
+// nonblocking reports whether the Dest's file descriptor should be put in
+// nonblocking mode. That is the case when the kernel, rather than a queue,
+// discards overflowing data.
+func (d *Dest) nonblocking() bool {
+	return d.Overflow == output.OverflowDropNewest && d.queueSize() == 0
 }
 
 // Open builds a writer associated with the receiver Dest struct. The writer's
@@ -100,16 +424,18 @@ func (d *Dest) openFD() (io.Writer, error) {
 		return nil, err
 	}
 
-	return output.NewBestEffortWriter(fd), nil
+	return d.fdWriter(fd), nil
 }
 
-// openFile creates a writer for a Dest whose type is TypeFile.
+// openFile creates a writer for a Dest whose type is TypeFile. The file is
+// truncated the first time it is opened, unless the Dest appends to it;
+// afterwards, it is always appended to.
 func (d *Dest) openFile() (io.Writer, error) {
 	mode := unix.O_WRONLY
 	if d.Create {
 		mode |= unix.O_CREAT
 	}
-	if d.Append {
+	if d.Append || d.opened {
 		mode |= unix.O_APPEND
 	} else {
 		mode |= unix.O_TRUNC
@@ -119,13 +445,14 @@ func (d *Dest) openFile() (io.Writer, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.opened = true
 
 	err = d.configureFD(fd)
 	if err != nil {
 		return nil, err
 	}
 
-	return output.NewBestEffortWriter(fd), nil
+	return d.fdWriter(fd), nil
 }
 
 // openFifo creates a writer for a Dest whose type is TypeFifo.
@@ -137,6 +464,10 @@ func (d *Dest) openFifo() (io.Writer, error) {
 		}
 	}
 
+	if d.Reconnect {
+		return output.NewReconnectWriter(d.openFifoReader, d.nonblocking()), nil
+	}
+
 	fd, err := unix.Open(d.ID, unix.O_RDWR, 0)
 	if err != nil {
 		return nil, err
@@ -147,33 +478,124 @@ func (d *Dest) openFifo() (io.Writer, error) {
 		return nil, err
 	}
 
-	return output.NewBestEffortWriter(fd), nil
+	return d.fdWriter(fd), nil
+}
+
+// openFifoReader opens a fifo for writing, provided it has a reader. It fails
+// with ENXIO otherwise. Unlike the O_RDWR descriptor a fifo is normally opened
+// with, the result doesn't let the kernel buffer data while no one is
+// reading.
+func (d *Dest) openFifoReader() (io.WriteCloser, error) {
+	fd, err := unix.Open(d.ID, unix.O_WRONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.nonblocking() {
+		err = setBlocking(fd)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	err = d.configureFD(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return d.fdWriter(fd), nil
 }
 
-// openProc creates a writer for a Dest whose type is TypeProc.
+// openProc creates a writer for a Dest whose type is TypeProc. rex creates
+// the child's stdin pipe itself, rather than using exec.Cmd.StdinPipe, so
+// that its end of the pipe can be configured like any other file descriptor.
 func (d *Dest) openProc() (io.Writer, error) {
-	cmd := exec.Command(d.ID, d.Args...)
+	var p [2]int
+	err := unix.Pipe2(p[:], unix.O_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	r := os.NewFile(uintptr(p[0]), "|0")
+	defer r.Close()
 
-	w, err := cmd.StdinPipe()
+	err = d.configureFD(p[1])
 	if err != nil {
+		unix.Close(p[1])
 		return nil, err
 	}
 
+	cmd := exec.Command(d.ID, d.Args...)
+	cmd.Stdin = r
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	err = cmd.Start()
 	if err != nil {
+		unix.Close(p[1])
 		return nil, err
 	}
 
-	return w, nil
+	// Reap the child whenever it exits, so that a Dest that is reopened
+	// after failures doesn't leave zombies behind. Its exit status does not
+	// concern rex.
+	go cmd.Wait()
+
+	return d.fdWriter(p[1]), nil
+}
+
+// fdWriter creates a writer for a configured file descriptor. If the Dest
+// splits its output into records, the writer never writes partial records.
+func (d *Dest) fdWriter(fd int) *output.BestEffortWriter {
+	var w *output.BestEffortWriter
+	if d.Framing != nil {
+		w = output.NewAtomicBestEffortWriter(fd)
+	} else {
+		w = output.NewBestEffortWriter(fd)
+	}
+
+	if d.Marker != "" {
+		w.SetMarker(d.markerFunc())
+	}
+
+	return w
+}
+
+// delim returns the bytes that terminate the Dest's records: its delimiter
+// if it splits its output into delimited records, a newline otherwise.
+func (d *Dest) delim() []byte {
+	if d.Framing != nil && d.Framing.Delimited() {
+		return d.Framing.Delim
+	}
+	return []byte{'\n'}
+}
+
+// markerFunc returns the function that builds the Dest's drop markers.
+func (d *Dest) markerFunc() output.MarkerFunc {
+	unit := "lines"
+	delim := d.delim()
+	if string(delim) != "\n" {
+		unit = "records"
+	}
+
+	switch d.Marker {
+	case "text":
+		return output.NewTextMarker(unit, delim)
+
+	case "json":
+		return output.NewJSONMarker(unit, delim)
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid marker: %s", d.Marker))
+	}
 }
 
 // configureFD configures a file descriptor with settings specified in the
 // receiver Dest struct's fields.
 func (d *Dest) configureFD(fd int) error {
-	if d.NonBlocking {
+	if d.nonblocking() {
 		err := setNonblocking(fd)
 		if err != nil {
 			return err
@@ -205,6 +627,21 @@ func setNonblocking(fd int) error {
 	return nil
 }
 
+// setBlocking takes the given file descriptor out of non-blocking mode.
+func setBlocking(fd int) error {
+	flags, err := unix.FcntlInt(uintptr(fd), syscall.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+
+	flags, err = unix.FcntlInt(uintptr(fd), syscall.F_SETFL, flags&^unix.O_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // setBufSize configures the pipe buffer size of the given file descriptor.
 // When applied to a non-pipe file descriptor, the behavior is unsepcified.
 func setBufSize(fd int, size int) error {
@@ -0,0 +1,53 @@
+package dest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
+)
+
+// NewGroupWriter builds a record writer for a failover group: it writes each
+// record to the highest-priority member that is healthy. The members must
+// agree on the options that apply to the group as a whole: the stream they
+// accept and whether they are optional. The group fails back to a member
+// after the shortest failback interval among them.
+func NewGroupWriter(ds []*Dest) (record.Writer, error) {
+	ds = append([]*Dest{}, ds...)
+	sort.SliceStable(ds, func(i, j int) bool { return ds[i].Priority < ds[j].Priority })
+
+	primary := ds[0]
+	failback := primary.Failback
+
+	var members []*output.FailoverMember
+	for _, d := range ds {
+		if d.Stream != primary.Stream {
+			return nil, fmt.Errorf("group %s: members accept different streams: %s and %s", d.Group, primary.Name(), d.Name())
+		}
+		if d.Optional != primary.Optional {
+			return nil, fmt.Errorf("group %s: members must all be optional or all be required: %s and %s", d.Group, primary.Name(), d.Name())
+		}
+		if d.Failback < failback {
+			failback = d.Failback
+		}
+
+		d := d
+		members = append(members, &output.FailoverMember{
+			Name: d.Name(),
+			Open: d.newWriter,
+		})
+	}
+
+	fw, err := output.NewFailoverWriter(primary.Group, members, failback)
+	if err != nil {
+		return nil, err
+	}
+
+	var rw record.Writer = fw
+	if primary.Optional {
+		rw = output.NewOptionalWriter(rw, "group "+primary.Group, fw)
+	}
+
+	return rw, nil
+}
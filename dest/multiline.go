@@ -0,0 +1,91 @@
+package dest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
+)
+
+// defaultMultilineMaxLines is the most lines a multiline record holds unless
+// the user specifies otherwise.
+const defaultMultilineMaxLines = 500
+
+// ParseMultiline parses a multiline setting into m. k is the setting's name
+// without its `multiline.` prefix: start, continue, maxlines, or timeout.
+func ParseMultiline(m *output.Multiline, k string, v string) error {
+	switch k {
+	case "start", "continue":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return err
+		}
+		if k == "start" {
+			m.Start = re
+		} else {
+			m.Continue = re
+		}
+		return nil
+
+	case "maxlines":
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf("maxlines must be positive: have=%d", n)
+		}
+		m.MaxLines = n
+		return nil
+
+	case "timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("timeout must be positive: have=%s", v)
+		}
+		m.Timeout = d
+		return nil
+
+	default:
+		return fmt.Errorf("unrecognized multiline setting: have=%s want=start|continue|maxlines|timeout", k)
+	}
+}
+
+// CheckMultiline verifies that m specifies which lines continue a record, and
+// fills in defaults.
+func CheckMultiline(m *output.Multiline) error {
+	if m.Start == nil && m.Continue == nil {
+		return fmt.Errorf("multiline requires multiline.start or multiline.continue")
+	}
+
+	if m.MaxLines == 0 {
+		m.MaxLines = defaultMultilineMaxLines
+	}
+
+	return nil
+}
+
+// DefaultMultiline folds the Dest's continuation lines as m specifies, unless
+// the Dest has multiline settings of its own. Like the multiline option, it
+// requires the Dest to have a delimited framing, if any.
+func (d *Dest) DefaultMultiline(m *output.Multiline) error {
+	if d.Multiline != nil {
+		return nil
+	}
+
+	if d.Framing == nil {
+		d.Framing = record.LineFraming()
+	}
+	if !d.Framing.Delimited() {
+		return fmt.Errorf("multiline requires a delimited framing: have=%s", d.Framing)
+	}
+
+	d.Multiline = m
+	return nil
+}
@@ -2,16 +2,48 @@ package dest
 
 import (
 	"fmt"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
+
+	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
 )
 
 // Example dest specifier string:
 // type=fifo,id=/tmp/myfifo,nonblocking,bufsize=102400,create
 
+var limitNameMap = map[string]output.RateLimit{
+	"drop":   output.RateDrop,
+	"delay":  output.RateDelay,
+	"sample": output.RateSample,
+}
+
+var timestampNameMap = map[string]output.TimestampFormat{
+	"rfc3339nano": output.TimestampRFC3339Nano,
+	"unix":        output.TimestampUnix,
+	"mono":        output.TimestampMono,
+}
+
+var formatNameMap = map[string]output.Format{
+	"raw":  output.FormatRaw,
+	"json": output.FormatJSON,
+}
+
+var overflowNameMap = map[string]output.Overflow{
+	"block":       output.OverflowBlock,
+	"drop-newest": output.OverflowDropNewest,
+	"drop-oldest": output.OverflowDropOldest,
+	"spill":       output.OverflowSpill,
+}
+
 type parser struct {
-	d       Dest
-	keyVals map[string]string
+	d        Dest
+	keyVals  map[string]string
+	required bool
 }
 
 // Parse parses the given dest specifier string, returning the resulting Dest
@@ -38,7 +70,7 @@ func (p *parser) parse(s string) error {
 	}
 
 	// Dest fields are separated by commas.
-	fields := strings.Split(s, ",")
+	fields := splitFields(s)
 
 	for _, t := range fields {
 		err := p.parseField(t)
@@ -55,9 +87,144 @@ func (p *parser) parse(s string) error {
 		return fmt.Errorf("missing 'id' field")
 	}
 
+	var framings []string
+	for _, k := range []string{"records", "delim", "framing"} {
+		if p.keyVals[k] != "" {
+			framings = append(framings, k)
+		}
+	}
+	if len(framings) > 1 {
+		return fail(fmt.Errorf("only one of records, delim, and framing may be given: have=%s", strings.Join(framings, ",")))
+	}
+
+	if p.d.Optional && p.required {
+		return fail(fmt.Errorf("optional and required are mutually exclusive"))
+	}
+
+	// A group already moves on from a failing member.
+	if p.d.Group != "" && p.d.Breaker > 0 {
+		return fail(fmt.Errorf("breaker is not supported for group members"))
+	}
+
+	// A spill directory implies the spill policy, and the spill policy
+	// requires a directory.
+	if p.d.Spill != "" {
+		if p.keyVals["overflow"] != "" && p.d.Overflow != output.OverflowSpill {
+			return fail(fmt.Errorf("spill requires overflow=spill: have=%s", p.keyVals["overflow"]))
+		}
+		p.d.Overflow = output.OverflowSpill
+	} else if p.d.Overflow == output.OverflowSpill {
+		return fail(fmt.Errorf("overflow=spill requires spill=<dir>"))
+	}
+
+	if p.d.SampleKey != nil && p.d.Sample == nil {
+		return fail(fmt.Errorf("samplekey requires sample"))
+	}
+
+	// A JSON envelope carries its own sequence number and timestamp.
+	if p.d.Format == output.FormatJSON {
+		if p.d.OutFormat != nil {
+			return fail(fmt.Errorf("outformat conflicts with format=json"))
+		}
+		if p.d.Seq {
+			return fail(fmt.Errorf("seq conflicts with format=json"))
+		}
+		if p.d.Timestamp != output.TimestampNone {
+			return fail(fmt.Errorf("timestamp conflicts with format=json"))
+		}
+	} else if p.d.Fields != nil {
+		return fail(fmt.Errorf("field.%s requires format=json", p.d.Fields[0].Key))
+	}
+
+	if p.d.Multiline != nil {
+		err := CheckMultiline(p.d.Multiline)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if p.d.InvalidTo != "" && p.d.Where == nil {
+		return fail(fmt.Errorf("invalid requires where"))
+	}
+
+	if p.d.RedactKey != nil && p.d.Redact == nil {
+		return fail(fmt.Errorf("redactkey requires redact or redactfile"))
+	}
+
+	// Multiline folding, sequence numbers, sampling, filters, redaction,
+	// stamps, and envelopes are per record, so they imply records. Default to
+	// lines.
+	perRecord := p.d.Seq || p.d.Sample != nil || p.d.Include != nil || p.d.Exclude != nil ||
+		p.d.Where != nil || p.d.OutFormat != nil || p.d.Multiline != nil ||
+		p.d.Redact != nil || p.d.Timestamp != output.TimestampNone || p.d.Prefix != "" ||
+		p.d.Format != output.FormatRaw
+	if perRecord && p.d.Framing == nil {
+		p.d.Framing = record.LineFraming()
+	}
+
+	// Options that rewrite records, or fold them together, need delimiters to
+	// tell records apart without reframing them.
+	if p.d.Framing != nil && !p.d.Framing.Delimited() {
+		rewrites := []struct {
+			name string
+			set  bool
+		}{
+			{"seq", p.d.Seq},
+			{"timestamp", p.d.Timestamp != output.TimestampNone},
+			{"prefix", p.d.Prefix != ""},
+			{"format", p.d.Format != output.FormatRaw},
+			{"outformat", p.d.OutFormat != nil},
+			{"redact", p.d.Redact != nil},
+			{"multiline", p.d.Multiline != nil},
+			{"marker", p.d.Marker != ""},
+		}
+		for _, r := range rewrites {
+			if r.set {
+				return fail(fmt.Errorf("%s requires a delimited framing: have=%s", r.name, p.keyVals["framing"]))
+			}
+		}
+	}
+
 	return nil
 }
 
+// splitFields splits a dest specifier string into fields at each comma. A
+// comma preceded by a backslash, or inside square brackets, is part of its
+// field, so that values such as regular expressions and the lists of where
+// conditions can contain commas. A bracket preceded by a backslash doesn't
+// count.
+func splitFields(s string) []string {
+	var fields []string
+	var field strings.Builder
+	depth := 0 // Number of unclosed brackets.
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == ',':
+			field.WriteByte(',')
+			i++
+
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '[' || s[i+1] == ']'):
+			field.WriteString(s[i : i+2])
+			i++
+
+		case s[i] == ',' && depth == 0:
+			fields = append(fields, field.String())
+			field.Reset()
+
+		default:
+			switch {
+			case s[i] == '[':
+				depth++
+			case s[i] == ']' && depth > 0:
+				depth--
+			}
+			field.WriteByte(s[i])
+		}
+	}
+
+	return append(fields, field.String())
+}
+
 // parseField parses a single dest specifier field. On success, it populates
 // the parser's internal dest struct accordingly.
 func (p *parser) parseField(field string) error {
@@ -74,19 +241,56 @@ func (p *parser) parseField(field string) error {
 	return err
 }
 
+// repeatableKeys are the keys that may be specified more than once in a dest
+// specifier string, with different values.
+var repeatableKeys = map[string]bool{
+	"include":    true,
+	"exclude":    true,
+	"redact":     true,
+	"redactfile": true,
+	"where":      true,
+}
+
 func (p *parser) parseKeyVal(k string, v string) error {
 	// Don't allow the same key to be specified twice in a dest specifier
-	// string.
-	if p.keyVals[k] == "" {
-		p.keyVals[k] = v
-	} else if p.keyVals[k] != v {
-		return fmt.Errorf("duplicate keyval: key=%s val1=%s val2=%s", k, p.keyVals[k], v)
+	// string, unless it is repeatable.
+	if !repeatableKeys[k] {
+		if p.keyVals[k] == "" {
+			p.keyVals[k] = v
+		} else if p.keyVals[k] != v {
+			return fmt.Errorf("duplicate keyval: key=%s val1=%s val2=%s", k, p.keyVals[k], v)
+		}
 	}
 
 	invalidVal := func(err error) error {
 		return fmt.Errorf("invalid %s: %w", k, err)
 	}
 
+	if name, ok := strings.CutPrefix(k, "multiline."); ok {
+		if p.d.Multiline == nil {
+			p.d.Multiline = &output.Multiline{}
+		}
+		err := ParseMultiline(p.d.Multiline, name, v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		return nil
+	}
+
+	// Static fields for JSON envelopes are keyed `field.<name>`.
+	if name, ok := strings.CutPrefix(k, "field."); ok {
+		if name == "" {
+			return fmt.Errorf("missing field name: %s", k)
+		}
+		if slices.Contains(output.EnvelopeKeys, name) {
+			return fmt.Errorf("reserved field name: have=%s want=none of %v", name, output.EnvelopeKeys)
+		}
+		if !slices.ContainsFunc(p.d.Fields, func(f output.Field) bool { return f.Key == name }) {
+			p.d.Fields = append(p.d.Fields, output.Field{Key: name, Value: v})
+		}
+		return nil
+	}
+
 	switch k {
 	case "type":
 		dt, ok := nameTypeMap[v]
@@ -113,6 +317,240 @@ func (p *parser) parseKeyVal(k string, v string) error {
 		p.d.Args = strings.Fields(allArgs)
 		return nil
 
+	case "stream":
+		p.d.Stream = v
+		return nil
+
+	case "records":
+		if v != "line" {
+			return fmt.Errorf("unrecognized records: have=%s want=line", v)
+		}
+		p.d.Framing = record.LineFraming()
+		return nil
+
+	case "delim":
+		delim, err := parseDelim(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Framing = &record.Framing{Kind: record.FramingDelim, Delim: []byte{delim}}
+		return nil
+
+	case "framing":
+		f, err := record.ParseFraming(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Framing = f
+		return nil
+
+	case "marker":
+		if v != "text" && v != "json" {
+			return fmt.Errorf("unrecognized marker: have=%s want=text|json", v)
+		}
+		p.d.Marker = v
+		return nil
+
+	case "overflow":
+		o, ok := overflowNameMap[v]
+		if !ok {
+			return fmt.Errorf("unrecognized overflow: have=%s want=block|drop-newest|drop-oldest|spill", v)
+		}
+		p.d.Overflow = o
+		return nil
+
+	case "queue":
+		qs, err := ParseSize(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.QueueSize = qs
+		return nil
+
+	case "spill":
+		p.d.Spill = v
+		return nil
+
+	case "spillmax":
+		sm, err := ParseSize(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.SpillMax = sm
+		return nil
+
+	case "timeout":
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be positive: have=%s", v)
+		}
+		p.d.Timeout = timeout
+		return nil
+
+	case "group":
+		p.d.Group = v
+		return nil
+
+	case "priority":
+		prio, err := strconv.Atoi(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Priority = prio
+		return nil
+
+	case "failback":
+		failback, err := time.ParseDuration(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Failback = failback
+		return nil
+
+	case "breaker":
+		threshold, err := strconv.Atoi(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		if threshold <= 0 {
+			return fmt.Errorf("breaker must be positive: have=%s", v)
+		}
+		p.d.Breaker = threshold
+		return nil
+
+	case "probe":
+		probe, err := time.ParseDuration(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Probe = probe
+		return nil
+
+	case "ratelimit":
+		rate, err := ParseRate(v, true)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.ByteRate = rate
+		return nil
+
+	case "linerate":
+		rate, err := ParseRate(v, false)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.LineRate = rate
+		return nil
+
+	case "limit":
+		l, ok := limitNameMap[v]
+		if !ok {
+			return fmt.Errorf("unrecognized limit: have=%s want=drop|delay|sample", v)
+		}
+		p.d.Limit = l
+		return nil
+
+	case "outformat":
+		of, err := parseOutFormat(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.OutFormat = of
+		return nil
+
+	case "invalid":
+		if v == "" {
+			return invalidVal(fmt.Errorf("empty output id"))
+		}
+		p.d.InvalidTo = v
+		return nil
+
+	case "where":
+		c, err := parseCond(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Where = append(p.d.Where, c)
+		return nil
+
+	case "format":
+		f, ok := formatNameMap[v]
+		if !ok {
+			return fmt.Errorf("unrecognized format: have=%s want=raw|json", v)
+		}
+		p.d.Format = f
+		return nil
+
+	case "timestamp":
+		f, ok := timestampNameMap[v]
+		if !ok {
+			return fmt.Errorf("unrecognized timestamp: have=%s want=rfc3339nano|unix|mono", v)
+		}
+		p.d.Timestamp = f
+		return nil
+
+	case "prefix":
+		if v == "" {
+			return invalidVal(fmt.Errorf("empty prefix"))
+		}
+		p.d.Prefix = v
+		return nil
+
+	case "sample":
+		sampling, err := parseSampling(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Sample = sampling
+		return nil
+
+	case "samplekey":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.SampleKey = re
+		return nil
+
+	case "include", "exclude":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		if k == "include" {
+			p.d.Include = append(p.d.Include, re)
+		} else {
+			p.d.Exclude = append(p.d.Exclude, re)
+		}
+		return nil
+
+	case "redact":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Redact = append(p.d.Redact, output.RedactRule{Re: re})
+		return nil
+
+	case "redactfile":
+		rules, err := loadRedactFile(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.Redact = append(p.d.Redact, rules...)
+		return nil
+
+	case "redactkey":
+		key, err := loadRedactKey(v)
+		if err != nil {
+			return invalidVal(err)
+		}
+		p.d.RedactKey = key
+		return nil
+
 	case "bufsize":
 		bs, err := strconv.Atoi(v)
 		if err != nil {
@@ -126,11 +564,118 @@ func (p *parser) parseKeyVal(k string, v string) error {
 	}
 }
 
+// samplePeriods maps the period units accepted by parseSampling to their
+// durations.
+var samplePeriods = map[string]time.Duration{
+	"s":   time.Second,
+	"min": time.Minute,
+	"h":   time.Hour,
+}
+
+// parseSampling parses a sampling specification: `1/<n>` to forward one
+// record in n, `<p>%` to forward each record with probability p percent, or
+// `first:<n>/<unit>` to forward the first n records of each second (s),
+// minute (min), or hour (h).
+func parseSampling(s string) (*output.Sampling, error) {
+	invalid := func(err error) (*output.Sampling, error) {
+		return nil, fmt.Errorf("have=%s want=1/<n>|<p>%%|first:<n>/s|min|h: %w", s, err)
+	}
+
+	if n, ok := strings.CutPrefix(s, "1/"); ok {
+		every, err := strconv.Atoi(n)
+		if err != nil {
+			return invalid(err)
+		}
+		if every <= 0 {
+			return invalid(fmt.Errorf("n must be positive"))
+		}
+		return &output.Sampling{Every: every}, nil
+	}
+
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return invalid(err)
+		}
+		if pct <= 0 || pct > 100 {
+			return invalid(fmt.Errorf("p must be in (0, 100]"))
+		}
+		return &output.Sampling{Percent: pct}, nil
+	}
+
+	if head, ok := strings.CutPrefix(s, "first:"); ok {
+		n, unit, ok := strings.Cut(head, "/")
+		if !ok {
+			return invalid(fmt.Errorf("missing period"))
+		}
+
+		first, err := strconv.Atoi(n)
+		if err != nil {
+			return invalid(err)
+		}
+		if first <= 0 {
+			return invalid(fmt.Errorf("n must be positive"))
+		}
+
+		per, ok := samplePeriods[unit]
+		if !ok {
+			return invalid(fmt.Errorf("unrecognized period: %s", unit))
+		}
+		return &output.Sampling{First: first, Per: per}, nil
+	}
+
+	return invalid(fmt.Errorf("unrecognized sampling"))
+}
+
+// parseOutFormat parses an output format: `logfmt`, `json`, `csv:<fields>`
+// with fields separated by commas or spaces, or `template:<go-template>`.
+func parseOutFormat(s string) (*output.OutFormat, error) {
+	switch s {
+	case "logfmt":
+		return &output.OutFormat{Kind: output.OutFormatLogfmt}, nil
+	case "json":
+		return &output.OutFormat{Kind: output.OutFormatJSON}, nil
+	}
+
+	if list, ok := strings.CutPrefix(s, "csv:"); ok {
+		fields := strings.FieldsFunc(list, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		if fields == nil {
+			return nil, fmt.Errorf("missing csv fields")
+		}
+		return &output.OutFormat{Kind: output.OutFormatCSV, Fields: fields}, nil
+	}
+
+	if text, ok := strings.CutPrefix(s, "template:"); ok {
+		tmpl, err := template.New("outformat").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return &output.OutFormat{Kind: output.OutFormatTemplate, Template: tmpl}, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized outformat: have=%s want=logfmt|json|csv:<fields>|template:<template>", s)
+}
+
+// parseDelim parses a record delimiter: a single character, which may be
+// written as a Go escape sequence such as `\t` or `\x00`.
+func parseDelim(s string) (byte, error) {
+	c, _, tail, err := strconv.UnquoteChar(s, 0)
+	if err != nil {
+		return 0, err
+	}
+	if tail != "" || c > 0xff {
+		return 0, fmt.Errorf("delimiter must be a single byte: %s", s)
+	}
+
+	return byte(c), nil
+}
+
 func (p *parser) parseStandalone(field string) error {
 	switch field {
 	case "nonblocking":
-		p.d.NonBlocking = true
-		return nil
+		return p.parseKeyVal("overflow", "drop-newest")
 
 	case "create":
 		p.d.Create = true
@@ -140,6 +685,22 @@ func (p *parser) parseStandalone(field string) error {
 		p.d.Append = true
 		return nil
 
+	case "seq":
+		p.d.Seq = true
+		return nil
+
+	case "reconnect":
+		p.d.Reconnect = true
+		return nil
+
+	case "optional":
+		p.d.Optional = true
+		return nil
+
+	case "required":
+		p.required = true
+		return nil
+
 	default:
 		return fmt.Errorf("unrecognized field")
 	}
@@ -0,0 +1,74 @@
+package dest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/badvassal/rex/output"
+)
+
+// loadRedactFile reads named redaction patterns from a file. Each line holds
+// a name, whitespace, and a regular expression that extends to the end of the
+// line. Blank lines and lines starting with `#` are ignored. For example:
+//
+//	email  [[:alnum:]._%+-]+@[[:alnum:].-]+\.[[:alpha:]]+
+//	bearer (?i)authorization: bearer (\S+)
+func loadRedactFile(path string) ([]output.RedactRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []output.RedactRule
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: missing pattern: have=%s want=<name> <regex>", path, lineNum, line)
+		}
+
+		name, expr := line[:i], strings.TrimSpace(line[i+1:])
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		rules = append(rules, output.RedactRule{
+			Name: name,
+			Re:   re,
+		})
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// loadRedactKey reads the HMAC key for redaction from a file. A trailing
+// newline is not part of the key.
+func loadRedactKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s: empty key", path)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,70 @@
+package dest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeSuffixes maps the unit suffixes accepted by ParseSize to their
+// multipliers.
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count with an optional unit suffix, such as
+// `65536`, `64K`, or `10GB`. Units are powers of 1024 and are not case
+// sensitive.
+func ParseSize(s string) (int, error) {
+	num := strings.ToUpper(s)
+	mult := 1
+	for _, ss := range sizeSuffixes {
+		if strings.HasSuffix(num, ss.suffix) {
+			num = strings.TrimSuffix(num, ss.suffix)
+			mult = ss.mult
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: have=%s want=<number>[K|M|G]: %w", s, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid size: have=%s want=non-negative", s)
+	}
+
+	return n * mult, nil
+}
+
+// ParseRate parses a rate per second, such as `500/s`. If sized is true, the
+// count may have a unit suffix, as accepted by ParseSize (e.g. `1MB/s`).
+func ParseRate(s string, sized bool) (int, error) {
+	num, ok := strings.CutSuffix(s, "/s")
+	if !ok {
+		return 0, fmt.Errorf("invalid rate: have=%s want=<number>/s", s)
+	}
+
+	if sized {
+		return ParseSize(num)
+	}
+
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: have=%s want=<number>/s: %w", s, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid rate: have=%s want=non-negative", s)
+	}
+
+	return n, nil
+}
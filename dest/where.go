@@ -0,0 +1,171 @@
+package dest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
+)
+
+// ResolveInvalid sends the records that Dests with `where` discard as not
+// JSON objects to the Dests their invalid options name. An output is named
+// by its id, or by its type and id, such as `file:invalid.log`. It receives
+// nothing else, and must accept the same stream as the Dests that name it.
+func ResolveInvalid(ds []*Dest) error {
+	for _, d := range ds {
+		if d.InvalidTo == "" {
+			continue
+		}
+
+		var target *Dest
+		for _, t := range ds {
+			if t == d || (t.ID != d.InvalidTo && t.Name() != d.InvalidTo) {
+				continue
+			}
+			if target != nil {
+				return fmt.Errorf("%s: invalid output is ambiguous: have=%s want=<type>:<id>", d.Name(), d.InvalidTo)
+			}
+			target = t
+		}
+
+		if target == nil {
+			return fmt.Errorf("%s: invalid output not found: have=%s", d.Name(), d.InvalidTo)
+		}
+		if target.Where != nil {
+			return fmt.Errorf("%s: invalid output has where conditions of its own: %s", d.Name(), target.Name())
+		}
+		if target.Stream != d.Stream {
+			return fmt.Errorf("%s: invalid output accepts a different stream: %s", d.Name(), target.Name())
+		}
+
+		target.Invalid = true
+		if target.Framing == nil {
+			target.Framing = record.LineFraming()
+		}
+	}
+
+	return nil
+}
+
+// parseCond parses a condition on a JSON field, such as `.level==error`,
+// `.http.status!=200`, `.service in [api auth]`, or `.service not in
+// ["api","auth"]`. Values in a list are separated by commas or spaces.
+func parseCond(s string) (*output.Cond, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, ".") {
+		return nil, fmt.Errorf("missing field path: have=%s want=.<field><op><value>", s)
+	}
+
+	end := strings.IndexAny(s, "=! ")
+	if end < 0 {
+		return nil, fmt.Errorf("missing operator: have=%s want===|!=|in|not in", s)
+	}
+
+	path := strings.Split(s[1:end], ".")
+	for _, key := range path {
+		if key == "" {
+			return nil, fmt.Errorf("invalid field path: %s", s[:end])
+		}
+	}
+
+	c := &output.Cond{
+		Path: path,
+	}
+
+	rest := strings.TrimSpace(s[end:])
+	var list bool
+	switch {
+	case strings.HasPrefix(rest, "=="):
+		c.Op = output.CondEq
+		rest = rest[2:]
+	case strings.HasPrefix(rest, "!="):
+		c.Op = output.CondNe
+		rest = rest[2:]
+	case strings.HasPrefix(rest, "in "):
+		c.Op = output.CondIn
+		rest = rest[3:]
+		list = true
+	case strings.HasPrefix(rest, "not in "):
+		c.Op = output.CondNotIn
+		rest = rest[7:]
+		list = true
+	default:
+		return nil, fmt.Errorf("missing operator: have=%s want===|!=|in|not in", s)
+	}
+	rest = strings.TrimSpace(rest)
+
+	if !list {
+		v, tail, err := parseCondValue(rest)
+		if err != nil {
+			return nil, err
+		}
+		if tail != "" {
+			return nil, fmt.Errorf("trailing text after value: %s", tail)
+		}
+		c.Values = []output.CondValue{v}
+		return c, nil
+	}
+
+	inner, ok := strings.CutPrefix(rest, "[")
+	if ok {
+		inner, ok = strings.CutSuffix(inner, "]")
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid list: have=%s want=[<value>...]", rest)
+	}
+
+	for {
+		inner = strings.TrimLeft(inner, ", ")
+		if inner == "" {
+			break
+		}
+
+		v, tail, err := parseCondValue(inner)
+		if err != nil {
+			return nil, err
+		}
+		c.Values = append(c.Values, v)
+		inner = tail
+	}
+	if c.Values == nil {
+		return nil, fmt.Errorf("empty list")
+	}
+
+	return c, nil
+}
+
+// parseCondValue parses the value at the start of s, which is either a
+// double-quoted JSON string or bare text extending to the next comma or space.
+// It returns the value and the text that follows it.
+func parseCondValue(s string) (output.CondValue, string, error) {
+	if s == "" {
+		return output.CondValue{}, "", fmt.Errorf("missing value")
+	}
+
+	if s[0] != '"' {
+		end := strings.IndexAny(s, ", ")
+		if end < 0 {
+			end = len(s)
+		}
+		return output.CondValue{Text: s[:end]}, strings.TrimSpace(s[end:]), nil
+	}
+
+	// Find the closing quote, skipping escaped characters.
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			var text string
+			err := json.Unmarshal([]byte(s[:i+1]), &text)
+			if err != nil {
+				return output.CondValue{}, "", fmt.Errorf("invalid string %s: %w", s[:i+1], err)
+			}
+			return output.CondValue{Text: text, Quoted: true}, strings.TrimSpace(s[i+1:]), nil
+		}
+	}
+
+	return output.CondValue{}, "", fmt.Errorf("unterminated string: %s", s)
+}
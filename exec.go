@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/badvassal/rex/source"
+)
+
+// Names of the input streams that carry the exec mode child's output.
+var execStreams = []string{"stdout", "stderr"}
+
+// startExec launches the given command for exec mode. The child inherits
+// rex's stdin. Its stdout and stderr are returned as two distinct inputs named
+// "stdout" and "stderr". They are not framed, so that partial lines, such as
+// prompts, reach the outputs as soon as the child writes them. Outputs that
+// split records do so for each stream separately.
+func startExec(args []string, bufSize int) (*exec.Cmd, []source.Input, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, fmt.Errorf("exec: %w", err)
+	}
+
+	return cmd, []source.Input{
+		source.NewStreamInput(stdout, execStreams[0], bufSize, nil),
+		source.NewStreamInput(stderr, execStreams[1], bufSize, nil),
+	}, nil
+}
+
+// waitExec waits for the exec mode child to terminate and returns the status
+// rex should exit with. It must not be called until both of the child's
+// output streams have been fully read.
+func waitExec(cmd *exec.Cmd) int {
+	err := cmd.Wait()
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		fatal(fmt.Errorf("exec: %w", err), false)
+	}
+
+	// Mimic the shell: a child killed by a signal yields 128+signum.
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return exitErr.ExitCode()
+}
@@ -7,9 +7,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
+	"github.com/badvassal/rex/source"
 )
 
 var readBufSize int
@@ -39,6 +44,22 @@ func fatal(err error, printUsage bool) {
 	os.Exit(exitStatus)
 }
 
+// closeInputs releases the inputs that hold resources beyond their
+// underlying streams, such as files that record read positions.
+func closeInputs(inputs []source.Input) {
+	for _, in := range inputs {
+		c, ok := in.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		err := c.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	}
+}
+
 func main() {
 	env, err := parseArgs()
 	if err != nil {
@@ -52,24 +73,143 @@ func main() {
 	// specified on the command line.
 	sw := output.NewSyncWriter(ctx, env.Writers)
 
-	// Continuously read from stdin, then use the synchronized writer to write
-	// the data to all destinations in parallel.
-	buf := make([]byte, env.ReadBufSize)
+	// In exec mode, the child's stdout and stderr are inputs too.
+	var cmd *exec.Cmd
+	inputs := env.Inputs
+	if env.Exec != nil {
+		var execInputs []source.Input
+		cmd, execInputs, err = startExec(env.Exec, env.ReadBufSize)
+		if err != nil {
+			fatal(err, false)
+		}
+		inputs = append(inputs, execInputs...)
+	}
+
+	// Continuously read from every input in parallel.
+	recs := make(chan *record.Record)
+	errs := make(chan error, len(inputs))
+
+	var wg sync.WaitGroup
+	for _, in := range inputs {
+		wg.Add(1)
+		go func(in source.Input) {
+			defer wg.Done()
+			errs <- in.Read(ctx, recs)
+		}(in)
+	}
+
+	go func() {
+		wg.Wait()
+		close(recs)
+		close(errs)
+	}()
+
+	// Stop reading on SIGINT or SIGTERM, but give the inputs a chance to
+	// record their positions before exiting.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	stop := func(sig os.Signal) {
+		cancel()
+
+		// Keep the records queued for outputs that spill to disk, so
+		// that the inputs' positions can cover them.
+		err := sw.Save()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+
+		closeInputs(inputs)
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}
+
+	// Use the synchronized writer to write each record to the destinations
+	// that accept its input, in the order the records were read. Records are
+	// written whole, so records from different inputs never get spliced
+	// together.
+	writers := map[string]*output.SyncWriter{}
+dispatch:
 	for {
-		n, readErr := os.Stdin.Read(buf)
+		var rec *record.Record
+		select {
+		case r, ok := <-recs:
+			if !ok {
+				break dispatch
+			}
+			rec = r
 
-		if n > 0 {
-			_, err := sw.Write(buf[:n])
+		// Report an input's failure as soon as it happens, rather than
+		// once every other input has ended, which a followed file or a
+		// persistent fifo never does.
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
 			if err != nil {
+				cancel()
+				closeInputs(inputs)
 				fatal(err, false)
 			}
+			continue
+
+		case sig := <-sigs:
+			stop(sig)
+		}
+
+		name := rec.Source
+		w := writers[name]
+		if w == nil {
+			w = sw.Select(func(i int) bool {
+				return env.Dests[i].Accepts(name)
+			})
+			writers[name] = w
+		}
+
+		err := w.WriteRecord(rec)
+		if err != nil {
+			fatal(err, false)
+		}
+
+		// Acknowledge the record only once it has left the destinations'
+		// queues, so that a followed file's state never covers data that
+		// could still be lost.
+		if rec.Ack != nil {
+			w.Track(rec.Ack)
 		}
+	}
+
+	closeInputs(inputs)
 
-		if readErr != nil {
-			if !errors.Is(readErr, io.EOF) {
-				fatal(fmt.Errorf("read: %w", readErr), false)
+	// Write out anything the destinations retained while waiting for the
+	// rest of a record, and wait for their queues to drain. A signal still
+	// stops rex meanwhile.
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- sw.Flush()
+	}()
+
+	select {
+	case err := <-flushed:
+		if err != nil {
+			fatal(err, false)
+		}
+
+	case sig := <-sigs:
+		stop(sig)
+	}
+
+	// The inputs' errors are sent before recs is closed, but may not have
+	// been received yet.
+	if errs != nil {
+		for err := range errs {
+			if err != nil {
+				fatal(err, false)
 			}
-			break
 		}
 	}
+
+	if cmd != nil {
+		os.Exit(waitExec(cmd))
+	}
 }
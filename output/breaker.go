@@ -0,0 +1,234 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// BreakerState is the state of a BreakerWriter's circuit.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // Writing normally.
+	BreakerOpen                         // Discarding records until the next probe.
+	BreakerHalfOpen                     // Probing with a single record.
+)
+
+var breakerStateNames = []string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// BreakerWriter implements record.Writer. It is a circuit breaker: it tracks
+// the health of a destination and stops writing to it after repeated
+// failures, rather than failing the rest of rex.
+//
+// When a write fails, the writer closes the destination and reopens it for
+// the next write. Once the number of consecutive failures reaches the
+// writer's threshold, the circuit opens: records are discarded without
+// touching the destination. After the probe interval, the circuit becomes
+// half-open, and the writer reopens the destination to write the next
+// record. If that succeeds, the circuit closes again; otherwise it reopens.
+// State transitions are logged to stderr.
+type BreakerWriter struct {
+	name      string
+	open      func() (record.Writer, io.Closer, error)
+	threshold int
+	probe     time.Duration
+
+	// mu guards the writer's state, since Save may be called while Flush is
+	// waiting for the destination.
+	mu sync.Mutex
+
+	w record.Writer // nil after a failure, until reopened.
+	c io.Closer
+
+	state    BreakerState
+	failures int       // Consecutive failures.
+	openedAt time.Time // When the circuit last opened.
+
+	dropped dropCount // Data discarded since the last report.
+}
+
+// NewBreakerWriter creates a BreakerWriter for the named destination, which
+// open builds a writer for. The destination is opened right away, so that it
+// fails at startup like any other destination.
+func NewBreakerWriter(name string, open func() (record.Writer, io.Closer, error), threshold int, probe time.Duration) (*BreakerWriter, error) {
+	bw := &BreakerWriter{
+		name:      name,
+		open:      open,
+		threshold: threshold,
+		probe:     probe,
+	}
+
+	var err error
+	bw.w, bw.c, err = open()
+	if err != nil {
+		return nil, err
+	}
+
+	return bw, nil
+}
+
+// WriteRecord writes a record to the destination, unless the circuit is
+// open. It never fails.
+func (bw *BreakerWriter) WriteRecord(rec *record.Record) error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if bw.state == BreakerOpen {
+		if time.Since(bw.openedAt) < bw.probe {
+			bw.drop(rec)
+			return nil
+		}
+		bw.transition(BreakerHalfOpen, "probing")
+	}
+
+	err := bw.write(rec)
+	if err != nil {
+		bw.drop(rec)
+		bw.fail(err)
+		return nil
+	}
+
+	bw.failures = 0
+	if bw.state == BreakerHalfOpen {
+		msg := "recovered"
+		if bw.dropped.any() {
+			msg += ": " + bw.dropped.String()
+		}
+		bw.transition(BreakerClosed, msg)
+		bw.dropped.reset()
+	} else if bw.dropped.any() {
+		// Records failed to write without opening the circuit.
+		bw.reportDropped()
+	}
+
+	return nil
+}
+
+// write writes a record to the destination, reopening it first if an earlier
+// write failed.
+func (bw *BreakerWriter) write(rec *record.Record) error {
+	if bw.w == nil {
+		var err error
+		bw.w, bw.c, err = bw.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.w.WriteRecord(rec)
+}
+
+// fail closes the destination after an error, and opens the circuit if the
+// destination has failed too often.
+func (bw *BreakerWriter) fail(err error) {
+	if bw.c != nil {
+		bw.c.Close()
+	}
+	bw.w = nil
+	bw.c = nil
+
+	bw.failures++
+	if bw.state == BreakerHalfOpen || bw.failures >= bw.threshold {
+		bw.openedAt = time.Now()
+		bw.transition(BreakerOpen, fmt.Sprintf("%d consecutive errors, last: %v", bw.failures, err))
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "warning: dest %s failed (%d/%d): %v\n", bw.name, bw.failures, bw.threshold, err)
+}
+
+// transition changes the circuit's state and logs the change.
+func (bw *BreakerWriter) transition(state BreakerState, reason string) {
+	fmt.Fprintf(os.Stderr, "warning: dest %s circuit %s -> %s: %s\n", bw.name, bw.state, state, reason)
+	bw.state = state
+}
+
+// drop records that the given record was discarded.
+func (bw *BreakerWriter) drop(rec *record.Record) {
+	bw.dropped.add(rec)
+}
+
+// Track arranges for done to be called once the records written so far have
+// left the destination. Records written while the destination is closed have
+// been discarded, so they have left it already.
+func (bw *BreakerWriter) Track(done func(ok bool)) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if bw.w == nil {
+		done(true)
+		return
+	}
+	record.Track(bw.w, done)
+}
+
+// Save saves the destination's queue for a later run, if it is open.
+func (bw *BreakerWriter) Save() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if bw.w == nil {
+		return nil
+	}
+	return save(bw.w)
+}
+
+// Flush flushes the destination if it retains data between writes. Like a
+// failed write, a failed flush counts against the destination rather than
+// failing. The lock is not held while the destination flushes, which may take
+// indefinitely, so that it can still be saved meanwhile.
+func (bw *BreakerWriter) Flush() error {
+	bw.mu.Lock()
+	w := bw.w
+	bw.mu.Unlock()
+
+	var err error
+	if f, ok := w.(record.Flusher); ok {
+		err = f.Flush()
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if err != nil && bw.w == w {
+		bw.fail(err)
+	}
+	if bw.dropped.any() {
+		bw.reportDropped()
+	}
+	return nil
+}
+
+// reportDropped reports the data discarded since the last report.
+func (bw *BreakerWriter) reportDropped() {
+	fmt.Fprintf(os.Stderr, "warning: dest %s circuit %s: %v\n", bw.name, bw.state, &bw.dropped)
+	bw.dropped.reset()
+}
+
+// Close closes the destination if it is open.
+func (bw *BreakerWriter) Close() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if bw.c == nil {
+		return nil
+	}
+
+	err := bw.c.Close()
+	bw.w = nil
+	bw.c = nil
+	return err
+}
@@ -0,0 +1,338 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/badvassal/rex/record"
+)
+
+// OutFormatKind is the format a ConvertWriter renders records in.
+type OutFormatKind int
+
+const (
+	OutFormatLogfmt   OutFormatKind = iota // key=value pairs.
+	OutFormatJSON                          // A compact JSON object.
+	OutFormatCSV                           // Selected fields as a CSV row.
+	OutFormatTemplate                      // The output of a Go template.
+)
+
+// OutFormat specifies how a ConvertWriter renders records.
+type OutFormat struct {
+	Kind     OutFormatKind
+	Fields   []string           // Fields of each CSV row.
+	Template *template.Template // Template executed with the record's fields.
+}
+
+// structured is a record parsed into fields, in the order they appeared.
+type structured struct {
+	keys   []string
+	values map[string]any
+}
+
+// parseStructured parses a record as a JSON object or, failing that, as
+// logfmt.
+func parseStructured(b []byte) (*structured, bool) {
+	if s, ok := parseJSONFields(b); ok {
+		return s, true
+	}
+	return parseLogfmt(b)
+}
+
+// parseJSONFields parses b as a JSON object, remembering the order of its
+// keys. Nested values are decoded as with ParseJSONObject.
+func parseJSONFields(b []byte) (*structured, bool) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+
+	s := &structured{
+		values: map[string]any{},
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key := tok.(string)
+
+		var v any
+		err = dec.Decode(&v)
+		if err != nil {
+			return nil, false
+		}
+		s.set(key, v)
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return nil, false
+	}
+	_, err = dec.Token()
+	if err != io.EOF {
+		return nil, false
+	}
+
+	return s, true
+}
+
+// parseLogfmt parses b as logfmt: space-separated `key=value` pairs, where a
+// value may be double-quoted, and a key without a value is true. So that plain
+// text isn't mistaken for logfmt, there must be at least one pair.
+func parseLogfmt(b []byte) (*structured, bool) {
+	s := &structured{
+		values: map[string]any{},
+	}
+	var pairs int
+
+	str := string(b)
+	for {
+		str = strings.TrimLeft(str, " \t")
+		if str == "" {
+			break
+		}
+
+		end := strings.IndexAny(str, "= \t\"")
+		if end < 0 {
+			end = len(str)
+		}
+		key := str[:end]
+		if key == "" {
+			return nil, false
+		}
+		str = str[end:]
+
+		if !strings.HasPrefix(str, "=") {
+			s.set(key, true)
+			continue
+		}
+		str = str[1:]
+		pairs++
+
+		if strings.HasPrefix(str, `"`) {
+			q, err := strconv.QuotedPrefix(str)
+			if err != nil {
+				return nil, false
+			}
+			v, err := strconv.Unquote(q)
+			if err != nil {
+				return nil, false
+			}
+			s.set(key, v)
+			str = str[len(q):]
+			continue
+		}
+
+		end = strings.IndexAny(str, " \t")
+		if end < 0 {
+			end = len(str)
+		}
+		s.set(key, str[:end])
+		str = str[end:]
+	}
+
+	if pairs == 0 {
+		return nil, false
+	}
+	return s, true
+}
+
+// set sets a field. A repeated key keeps its first position and last value.
+func (s *structured) set(key string, v any) {
+	if _, ok := s.values[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.values[key] = v
+}
+
+// get returns a field by key or, failing that, by dotted path into nested
+// objects.
+func (s *structured) get(key string) (any, bool) {
+	if v, ok := s.values[key]; ok {
+		return v, true
+	}
+	return lookup(s.values, strings.Split(key, "."))
+}
+
+// ConvertWriter implements record.Writer. It parses each record as a JSON
+// object or as logfmt, and renders it in another format before passing it on.
+// Records that parse as neither are passed on unchanged.
+type ConvertWriter struct {
+	w  record.Writer
+	of OutFormat
+
+	warned bool // Whether a template error has been reported.
+}
+
+// NewConvertWriter creates a ConvertWriter.
+func NewConvertWriter(w record.Writer, of OutFormat) *ConvertWriter {
+	return &ConvertWriter{
+		w:  w,
+		of: of,
+	}
+}
+
+func (cw *ConvertWriter) WriteRecord(rec *record.Record) error {
+	s, ok := parseStructured(rec.Data)
+	if !ok {
+		return cw.w.WriteRecord(rec)
+	}
+
+	data, err := cw.render(s)
+	if err != nil {
+		// A template that fails on some records shouldn't stop the rest.
+		if !cw.warned {
+			fmt.Fprintf(os.Stderr, "warning: outformat: %v; passing records through unchanged\n", err)
+			cw.warned = true
+		}
+		return cw.w.WriteRecord(rec)
+	}
+
+	r := *rec
+	r.Data = data
+	return cw.w.WriteRecord(&r)
+}
+
+// render renders a parsed record in the writer's format.
+func (cw *ConvertWriter) render(s *structured) ([]byte, error) {
+	switch cw.of.Kind {
+	case OutFormatLogfmt:
+		var b []byte
+		for i, key := range s.keys {
+			if i > 0 {
+				b = append(b, ' ')
+			}
+			b = append(b, key...)
+			b = append(b, '=')
+			b = appendLogfmtValue(b, s.values[key])
+		}
+		return b, nil
+
+	case OutFormatJSON:
+		b := []byte{'{'}
+		for i, key := range s.keys {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = AppendJSONString(b, []byte(key))
+			b = append(b, ':')
+			b = appendJSONValue(b, s.values[key])
+		}
+		return append(b, '}'), nil
+
+	case OutFormatCSV:
+		row := make([]string, len(cw.of.Fields))
+		for i, key := range cw.of.Fields {
+			if v, ok := s.get(key); ok {
+				row[i] = formatText(v)
+			}
+		}
+
+		var buf bytes.Buffer
+		csvw := csv.NewWriter(&buf)
+		csvw.Write(row)
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+
+	case OutFormatTemplate:
+		var buf bytes.Buffer
+		err := cw.of.Template.Execute(&buf, s.values)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid output format: %v", cw.of.Kind))
+	}
+}
+
+// formatText returns a field's value as plain text: strings as they are, and
+// everything else as JSON.
+func formatText(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return string(appendJSONValue(nil, v))
+}
+
+// appendLogfmtValue appends a field's value to b in logfmt. Values are quoted
+// if they would otherwise be ambiguous; objects and arrays are written as
+// quoted JSON.
+func appendLogfmtValue(b []byte, v any) []byte {
+	s := formatText(v)
+	if s == "" || strings.ContainsAny(s, " =\"\\") || !utf8.ValidString(s) || hasControl(s) {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+// hasControl reports whether s contains control characters.
+func hasControl(s string) bool {
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// appendJSONValue appends a decoded JSON value to b. Strings go through
+// AppendJSONString, so that the result is valid even for invalid UTF-8.
+func appendJSONValue(b []byte, v any) []byte {
+	switch t := v.(type) {
+	case string:
+		return AppendJSONString(b, []byte(t))
+
+	case json.Number:
+		return append(b, t...)
+
+	case bool:
+		return strconv.AppendBool(b, t)
+
+	case nil:
+		return append(b, "null"...)
+
+	case []any:
+		b = append(b, '[')
+		for i, e := range t {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONValue(b, e)
+		}
+		return append(b, ']')
+
+	case map[string]any:
+		// Nested objects come from json.Decoder, which doesn't keep key
+		// order, so json.Marshal's sorted order is as good as any.
+		m, err := json.Marshal(t)
+		if err != nil {
+			return append(b, "null"...)
+		}
+		return append(b, m...)
+
+	default:
+		panic(fmt.Sprintf("internal error: unexpected JSON value: %T", v))
+	}
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (cw *ConvertWriter) Flush() error {
+	return flush(cw.w)
+}
@@ -0,0 +1,229 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// FailoverMember is a destination in a failover group.
+type FailoverMember struct {
+	Name string
+
+	// Open builds a writer for the destination, along with a closer that
+	// releases it. The closer may be nil.
+	Open func() (record.Writer, io.Closer, error)
+
+	w record.Writer // nil until opened, and after a failure.
+	c io.Closer
+}
+
+// FailoverWriter implements record.Writer. It writes each record to one
+// member of a group of destinations, ordered by priority: the
+// highest-priority member that is healthy. When a write to a member fails,
+// the member is closed and the record goes to the next member instead. Once
+// the failback interval has elapsed, the writer reopens the failed members
+// that outrank the current one and tries them again.
+//
+// A record whose write failed may have been partially delivered to the
+// failed member, so a record can reach more than one member. A member with a
+// queue reports a failure only after it has accepted records: the records
+// still in its queue when it fails are not re-routed. They are kept in the
+// member's spill directory, if it has one, and written once the member is
+// reopened; otherwise they are lost.
+type FailoverWriter struct {
+	name     string
+	members  []*FailoverMember // Highest priority first.
+	failback time.Duration
+
+	// mu guards the writer's state, including its members', since Save may
+	// be called while Flush is waiting for a member.
+	mu sync.Mutex
+
+	active  int       // Index of the member receiving data.
+	retryAt time.Time // When to try members that outrank the active one.
+}
+
+// NewFailoverWriter creates a FailoverWriter for the named group. Members
+// must be ordered by priority, highest first. The highest-priority member
+// that can be opened is opened right away, like any other destination; the
+// others are opened when they are first needed. It fails only if no member
+// can be opened.
+func NewFailoverWriter(name string, members []*FailoverMember, failback time.Duration) (*FailoverWriter, error) {
+	fw := &FailoverWriter{
+		name:     name,
+		members:  members,
+		failback: failback,
+	}
+
+	var err error
+	for i, m := range members {
+		err = fw.open(m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: group %s: dest %s failed: %v\n", name, m.Name, err)
+			continue
+		}
+
+		if i > 0 {
+			fmt.Fprintf(os.Stderr, "warning: group %s: switched to dest %s\n", name, m.Name)
+			fw.active = i
+			fw.retryAt = time.Now().Add(failback)
+		}
+		return fw, nil
+	}
+
+	return nil, fmt.Errorf("group %s: all destinations failed: %w", name, err)
+}
+
+// WriteRecord writes a record to the highest-priority member that accepts it.
+// It fails only if every member fails.
+func (fw *FailoverWriter) WriteRecord(rec *record.Record) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	start := fw.active
+	if start > 0 && !time.Now().Before(fw.retryAt) {
+		start = 0
+	}
+
+	var err error
+	for i := start; i < len(fw.members); i++ {
+		m := fw.members[i]
+
+		err = fw.write(m, rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: group %s: dest %s failed: %v\n", fw.name, m.Name, err)
+			fw.close(m)
+			continue
+		}
+
+		if i != fw.active {
+			fmt.Fprintf(os.Stderr, "warning: group %s: switched to dest %s\n", fw.name, m.Name)
+			fw.active = i
+		}
+		if i > start {
+			fw.retryAt = time.Now().Add(fw.failback)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("group %s: all destinations failed: %w", fw.name, err)
+}
+
+// write writes a record to a member, opening the member first if necessary.
+func (fw *FailoverWriter) write(m *FailoverMember, rec *record.Record) error {
+	if m.w == nil {
+		err := fw.open(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.w.WriteRecord(rec)
+}
+
+// open opens a member.
+func (fw *FailoverWriter) open(m *FailoverMember) error {
+	w, c, err := m.Open()
+	if err != nil {
+		return err
+	}
+
+	m.w = w
+	m.c = c
+	return nil
+}
+
+// close releases a member after a failure.
+func (fw *FailoverWriter) close(m *FailoverMember) {
+	if m.c != nil {
+		err := m.c.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: group %s: dest %s: close: %v\n", fw.name, m.Name, err)
+		}
+	}
+
+	m.w = nil
+	m.c = nil
+}
+
+// Track arranges for done to be called once the records written so far have
+// left every member that is open. Records may still be queued for a member
+// that is no longer the active one.
+func (fw *FailoverWriter) Track(done func(ok bool)) {
+	var ws []record.Writer
+	for _, m := range fw.opened() {
+		ws = append(ws, m.w)
+	}
+	trackAll(ws, done)
+}
+
+// opened returns copies of the members that are open, as they are now.
+func (fw *FailoverWriter) opened() []FailoverMember {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	var ms []FailoverMember
+	for _, m := range fw.members {
+		if m.w != nil {
+			ms = append(ms, *m)
+		}
+	}
+	return ms
+}
+
+// Save saves the queues of the members that are open for a later run.
+func (fw *FailoverWriter) Save() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	for _, m := range fw.members {
+		if m.w == nil {
+			continue
+		}
+
+		err := save(m.w)
+		if err != nil {
+			return fmt.Errorf("group %s: dest %s: %w", fw.name, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Flush flushes the members that are open, if they retain data between
+// writes. The lock is not held while a member flushes, which may take
+// indefinitely, so that the members can still be saved meanwhile.
+func (fw *FailoverWriter) Flush() error {
+	for _, m := range fw.opened() {
+		f, ok := m.w.(record.Flusher)
+		if !ok {
+			continue
+		}
+
+		err := f.Flush()
+		if err != nil {
+			return fmt.Errorf("group %s: dest %s: %w", fw.name, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes every member that is open.
+func (fw *FailoverWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	for _, m := range fw.members {
+		if m.w != nil {
+			fw.close(m)
+		}
+	}
+
+	return nil
+}
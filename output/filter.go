@@ -0,0 +1,55 @@
+package output
+
+import (
+	"regexp"
+
+	"github.com/badvassal/rex/record"
+)
+
+// FilterWriter implements record.Writer. It forwards only the records that
+// match at least one of its include expressions, if it has any, and none of
+// its exclude expressions.
+type FilterWriter struct {
+	w       record.Writer
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func NewFilterWriter(w record.Writer, include []*regexp.Regexp, exclude []*regexp.Regexp) *FilterWriter {
+	return &FilterWriter{
+		w:       w,
+		include: include,
+		exclude: exclude,
+	}
+}
+
+func (fw *FilterWriter) WriteRecord(rec *record.Record) error {
+	if !fw.match(rec.Data) {
+		return nil
+	}
+	return fw.w.WriteRecord(rec)
+}
+
+// match reports whether the given record data passes the filter.
+func (fw *FilterWriter) match(b []byte) bool {
+	for _, re := range fw.exclude {
+		if re.Match(b) {
+			return false
+		}
+	}
+
+	if len(fw.include) == 0 {
+		return true
+	}
+	for _, re := range fw.include {
+		if re.Match(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (fw *FilterWriter) Flush() error {
+	return flush(fw.w)
+}
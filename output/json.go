@@ -0,0 +1,157 @@
+package output
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/badvassal/rex/record"
+)
+
+// Format specifies how records are encoded for a destination.
+type Format int
+
+const (
+	FormatRaw  Format = iota // As read.
+	FormatJSON               // Wrapped in JSON envelopes by a JSONWriter.
+)
+
+// Field is a static key-value pair included in every JSON envelope.
+type Field struct {
+	Key   string
+	Value string
+}
+
+// EnvelopeKeys are the keys a JSONWriter sets itself. Static fields may not
+// use them.
+var EnvelopeKeys = []string{"time", "host", "instance", "source", "seq", "line", "line_base64"}
+
+// instanceID identifies this run of rex, so that envelopes from different
+// runs on the same host can be told apart.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		// Fall back to something that is at least unique per host.
+		return fmt.Sprintf("%x-%x", os.Getpid(), time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// JSONWriter implements record.Writer. It wraps each record in a JSON object,
+// one per line, such as:
+//
+//	{"time":"2023-10-11T15:04:05.123456789Z","host":"web1","instance":"5f1c2a9e0b7d4c31","source":"stdin","seq":1,"env":"prod","line":"GET / 200"}
+//
+// time is when rex read the record, and seq counts the records written to the
+// destination. Bytes of the record that are not valid UTF-8 appear as U+FFFD
+// in line; the exact record is then also included, base64-encoded, in
+// line_base64.
+type JSONWriter struct {
+	w      record.Writer
+	fields []Field
+	delim  []byte
+	host   string
+	seq    uint64
+}
+
+// NewJSONWriter creates a JSONWriter that terminates each object with delim.
+func NewJSONWriter(w record.Writer, fields []Field, delim []byte) (*JSONWriter, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("hostname: %w", err)
+	}
+
+	return &JSONWriter{
+		w:      w,
+		fields: fields,
+		delim:  delim,
+		host:   host,
+	}, nil
+}
+
+func (jw *JSONWriter) WriteRecord(rec *record.Record) error {
+	jw.seq++
+
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	b := append([]byte(nil), `{"time":"`...)
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, `","host":`...)
+	b = AppendJSONString(b, []byte(jw.host))
+	b = append(b, `,"instance":"`...)
+	b = append(b, instanceID...)
+	b = append(b, `","source":`...)
+	b = AppendJSONString(b, []byte(rec.Source))
+	b = append(b, `,"seq":`...)
+	b = strconv.AppendUint(b, jw.seq, 10)
+	for _, f := range jw.fields {
+		b = append(b, ',')
+		b = AppendJSONString(b, []byte(f.Key))
+		b = append(b, ':')
+		b = AppendJSONString(b, []byte(f.Value))
+	}
+	b = append(b, `,"line":`...)
+	b = AppendJSONString(b, rec.Data)
+	if !utf8.Valid(rec.Data) {
+		b = append(b, `,"line_base64":"`...)
+		b = append(b, base64.StdEncoding.EncodeToString(rec.Data)...)
+		b = append(b, '"')
+	}
+	b = append(b, '}')
+
+	r := *rec
+	r.Data = b
+	r.Delim = jw.delim
+	return jw.w.WriteRecord(&r)
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (jw *JSONWriter) Flush() error {
+	return flush(jw.w)
+}
+
+// AppendJSONString appends s to b as a quoted JSON string. Bytes that are not
+// valid UTF-8 are replaced with U+FFFD, so the result is always valid JSON.
+// Line and paragraph separators are escaped too, for the sake of consumers
+// that treat them as line breaks.
+func AppendJSONString(b []byte, s []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+
+	b = append(b, '"')
+	for len(s) > 0 {
+		r, n := utf8.DecodeRune(s)
+		switch {
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r == '\n':
+			b = append(b, `\n`...)
+		case r == '\r':
+			b = append(b, `\r`...)
+		case r == '\t':
+			b = append(b, `\t`...)
+		case r < 0x20:
+			b = append(b, '\\', 'u', '0', '0', hexDigits[r>>4], hexDigits[r&0xf])
+		case r == utf8.RuneError && n == 1:
+			b = append(b, `\ufffd`...)
+		case r == '\u2028':
+			b = append(b, `\u2028`...)
+		case r == '\u2029':
+			b = append(b, `\u2029`...)
+		default:
+			b = append(b, s[:n]...)
+		}
+		s = s[n:]
+	}
+	return append(b, '"')
+}
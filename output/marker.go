@@ -0,0 +1,63 @@
+package output
+
+import (
+	"fmt"
+
+	"github.com/badvassal/rex/record"
+)
+
+// MarkerFunc builds an in-band marker reporting that the given numbers of
+// bytes and records were discarded.
+type MarkerFunc func(bytes int, records int) []byte
+
+// NewTextMarker returns a MarkerFunc that builds human-readable markers, such
+// as `[rex: dropped 18342 bytes / 97 lines]`. unit names the kind of record
+// (e.g. "lines"); delim terminates the marker.
+func NewTextMarker(unit string, delim []byte) MarkerFunc {
+	return func(bytes int, records int) []byte {
+		m := fmt.Sprintf("[rex: dropped %d bytes / %d %s]", bytes, records, unit)
+		return append([]byte(m), delim...)
+	}
+}
+
+// NewJSONMarker returns a MarkerFunc that builds JSON markers, such as
+// `{"rex_dropped_bytes":18342,"rex_dropped_lines":97}`. unit names the kind of
+// record (e.g. "lines"); delim terminates the marker.
+func NewJSONMarker(unit string, delim []byte) MarkerFunc {
+	return func(bytes int, records int) []byte {
+		m := fmt.Sprintf(`{"rex_dropped_bytes":%d,"rex_dropped_%s":%d}`, bytes, unit, records)
+		return append([]byte(m), delim...)
+	}
+}
+
+// dropCount tallies the data a writer has discarded and not yet reported,
+// whether in-band with a marker or on stderr.
+type dropCount struct {
+	bytes   int
+	records int
+}
+
+// add counts a discarded record.
+func (dc *dropCount) add(rec *record.Record) {
+	dc.bytes += recordSize(rec)
+	dc.records++
+}
+
+// any reports whether anything is left to report.
+func (dc *dropCount) any() bool {
+	return dc.bytes > 0 || dc.records > 0
+}
+
+// marker builds a marker reporting the count with m.
+func (dc *dropCount) marker(m MarkerFunc) []byte {
+	return m(dc.bytes, dc.records)
+}
+
+// reset starts a new count, once the current one has been reported.
+func (dc *dropCount) reset() {
+	*dc = dropCount{}
+}
+
+func (dc *dropCount) String() string {
+	return fmt.Sprintf("dropped %d bytes / %d records", dc.bytes, dc.records)
+}
@@ -0,0 +1,208 @@
+package output
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// Multiline specifies how a MultilineWriter recognizes the lines that continue
+// a record, such as the lines of a stack trace. At least one of Start and
+// Continue is set.
+type Multiline struct {
+	Start    *regexp.Regexp // Lines that don't match continue the record; nil if unused.
+	Continue *regexp.Regexp // Lines that match continue the record; nil if unused.
+	MaxLines int            // Most lines in a record.
+	Timeout  time.Duration  // Longest to wait for a continuation line; 0 for no limit.
+}
+
+// continues reports whether a line continues the record before it.
+func (m *Multiline) continues(line []byte) bool {
+	if m.Continue != nil && m.Continue.Match(line) {
+		return true
+	}
+	return m.Start != nil && !m.Start.Match(line)
+}
+
+// multilineGroup is a record being assembled from one stream's lines.
+type multilineGroup struct {
+	rec   *record.Record
+	lines int
+	timer *time.Timer // Writes the record if no line continues it in time.
+
+	// Callbacks waiting for the record to be written.
+	waiting []func(ok bool)
+}
+
+// MultilineWriter implements record.Writer. It folds continuation lines into
+// the record they continue, so that a multiline record such as a stack trace
+// is written, filtered, and sampled as a whole. The lines of a record are
+// joined with their delimiters.
+//
+// A record is written once a line that doesn't continue it arrives, once it
+// reaches the maximum number of lines, or, if the writer has a timeout, once
+// no line has continued it for that long, or once its stream ends. Lines from
+// different streams are never folded together.
+//
+// The writer is a record.Tracker: the lines of a record it is assembling have
+// not left it until the record is written.
+type MultilineWriter struct {
+	w record.Writer
+	m Multiline
+
+	// mu serializes writes to w, which the timeout makes from other
+	// goroutines.
+	mu     sync.Mutex
+	groups map[record.Stream]*multilineGroup
+	err    error // Error from a write made on timeout.
+}
+
+// NewMultilineWriter creates a MultilineWriter.
+func NewMultilineWriter(w record.Writer, m Multiline) *MultilineWriter {
+	return &MultilineWriter{
+		w:      w,
+		m:      m,
+		groups: map[record.Stream]*multilineGroup{},
+	}
+}
+
+func (mw *MultilineWriter) WriteRecord(rec *record.Record) error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.err != nil {
+		return mw.err
+	}
+
+	stream := rec.Stream()
+	g := mw.groups[stream]
+	if g != nil && mw.m.continues(rec.Data) {
+		data := make([]byte, 0, len(g.rec.Data)+len(g.rec.Delim)+len(rec.Data))
+		data = append(data, g.rec.Data...)
+		data = append(data, g.rec.Delim...)
+		data = append(data, rec.Data...)
+
+		r := *rec
+		r.Data = data
+		r.Time = g.rec.Time
+		g.rec = &r
+		g.lines++
+	} else {
+		err := mw.writeGroup(stream)
+		if err != nil {
+			return err
+		}
+
+		g = &multilineGroup{
+			rec:   rec,
+			lines: 1,
+		}
+		mw.groups[stream] = g
+	}
+
+	// An unterminated line is the last of its stream.
+	if g.lines >= mw.m.MaxLines || rec.Unterminated {
+		return mw.writeGroup(stream)
+	}
+
+	if mw.m.Timeout > 0 {
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		g.timer = time.AfterFunc(mw.m.Timeout, func() {
+			mw.mu.Lock()
+			defer mw.mu.Unlock()
+
+			// The group may have been written, or replaced, meanwhile.
+			if mw.groups[stream] != g {
+				return
+			}
+			err := mw.writeGroup(stream)
+			if err != nil && mw.err == nil {
+				mw.err = err
+			}
+		})
+	}
+
+	return nil
+}
+
+// writeGroup writes the record being assembled for the given stream, if any.
+// The caller must hold the lock.
+func (mw *MultilineWriter) writeGroup(stream record.Stream) error {
+	g := mw.groups[stream]
+	if g == nil {
+		return nil
+	}
+
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	delete(mw.groups, stream)
+
+	err := mw.w.WriteRecord(g.rec)
+	for _, done := range g.waiting {
+		if err != nil {
+			done(false)
+			continue
+		}
+		record.Track(mw.w, done)
+	}
+
+	return err
+}
+
+// Track arranges for done to be called once the records written so far have
+// left the writer: once the records it is assembling have been written, and
+// the records written have left the underlying writer.
+func (mw *MultilineWriter) Track(done func(ok bool)) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.err != nil {
+		done(false)
+		return
+	}
+
+	if len(mw.groups) == 0 {
+		record.Track(mw.w, done)
+		return
+	}
+
+	done = record.TrackAll(len(mw.groups), done)
+	for _, g := range mw.groups {
+		g.waiting = append(g.waiting, done)
+	}
+}
+
+// Flush writes the records being assembled for every stream, and flushes
+// the underlying writer if it retains data between writes.
+func (mw *MultilineWriter) Flush() error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.err != nil {
+		// The records being assembled will never be written.
+		for stream, g := range mw.groups {
+			if g.timer != nil {
+				g.timer.Stop()
+			}
+			for _, done := range g.waiting {
+				done(false)
+			}
+			delete(mw.groups, stream)
+		}
+		return mw.err
+	}
+
+	for stream := range mw.groups {
+		err := mw.writeGroup(stream)
+		if err != nil {
+			return err
+		}
+	}
+
+	return flush(mw.w)
+}
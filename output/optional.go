@@ -0,0 +1,120 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/badvassal/rex/record"
+)
+
+// OptionalWriter implements record.Writer. It shields the rest of rex from
+// the failure of an optional destination: when a write or flush fails, it
+// reports the error on stderr, closes the destination, and silently discards
+// everything written to it afterwards.
+type OptionalWriter struct {
+	w      record.Writer
+	name   string
+	closer io.Closer // nil if the destination needs no closing.
+
+	// mu guards err, since Save may be called while Flush is waiting for
+	// the destination.
+	mu  sync.Mutex
+	err error // The error that detached the destination; nil until then.
+
+	dropped dropCount // Data discarded since the destination was detached.
+}
+
+// NewOptionalWriter creates an OptionalWriter for the named destination. c
+// is closed when the destination is detached; it may be nil.
+func NewOptionalWriter(w record.Writer, name string, c io.Closer) *OptionalWriter {
+	return &OptionalWriter{
+		w:      w,
+		name:   name,
+		closer: c,
+	}
+}
+
+func (ow *OptionalWriter) WriteRecord(rec *record.Record) error {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+
+	if ow.err == nil {
+		err := ow.w.WriteRecord(rec)
+		if err == nil {
+			return nil
+		}
+		ow.detach(err)
+	}
+
+	ow.dropped.add(rec)
+	return nil
+}
+
+// Track arranges for done to be called once the records written so far have
+// left the underlying writer. Once the destination is detached, records are
+// discarded, so they have left it already.
+func (ow *OptionalWriter) Track(done func(ok bool)) {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+
+	if ow.err != nil {
+		done(true)
+		return
+	}
+	record.Track(ow.w, done)
+}
+
+// Save saves the underlying writer's queue for a later run, unless the
+// destination has been detached.
+func (ow *OptionalWriter) Save() error {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+
+	if ow.err != nil {
+		return nil
+	}
+	return save(ow.w)
+}
+
+// Flush flushes the underlying writer if it retains data between writes. If
+// the destination has been detached, it reports how much data was discarded
+// instead. The lock is not held while the underlying writer flushes, which
+// may take indefinitely, so that it can still be saved meanwhile.
+func (ow *OptionalWriter) Flush() error {
+	ow.mu.Lock()
+	detached := ow.err != nil
+	ow.mu.Unlock()
+
+	var err error
+	if !detached {
+		err = flush(ow.w)
+	}
+
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+
+	if err != nil && ow.err == nil {
+		ow.detach(err)
+	}
+
+	if ow.dropped.any() {
+		fmt.Fprintf(os.Stderr, "warning: dest %s detached: %v\n", ow.name, &ow.dropped)
+		ow.dropped.reset()
+	}
+	return nil
+}
+
+// detach stops writing to the destination after the given error.
+func (ow *OptionalWriter) detach(err error) {
+	ow.err = err
+	fmt.Fprintf(os.Stderr, "warning: dest %s failed, detaching: %v\n", ow.name, err)
+
+	if ow.closer != nil {
+		err := ow.closer.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: dest %s: close: %v\n", ow.name, err)
+		}
+	}
+}
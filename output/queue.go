@@ -0,0 +1,551 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/badvassal/rex/record"
+)
+
+// errQueueSaved is the error a QueueWriter reports once it has been saved.
+var errQueueSaved = errors.New("queue saved for a later run")
+
+// errQueueClosed is the error a QueueWriter reports once it has been closed.
+var errQueueClosed = errors.New("queue closed")
+
+// Saver is implemented by writers that can keep the records they have not
+// written out yet for a later run of rex, such as queues that spill to disk.
+type Saver interface {
+	// Save stores the records still held for a later run, and stops
+	// writing. Records that can't be stored are lost.
+	Save() error
+}
+
+// Overflow specifies what a queue does with a record that doesn't fit.
+type Overflow int
+
+const (
+	OverflowBlock      Overflow = iota // Wait for room.
+	OverflowDropNewest                 // Discard the incoming record.
+	OverflowDropOldest                 // Discard queued records to make room.
+	OverflowSpill                      // Append the record to a disk queue.
+)
+
+// QueueWriter implements record.Writer. It holds records in a bounded
+// in-memory queue and writes them to the underlying writer in a dedicated
+// goroutine. A slow destination behind a queue only affects the rest of rex
+// once its queue is full; until then, it drains at its own pace. What happens
+// when the queue is full depends on the queue's overflow policy.
+//
+// Records are queued by reference. This is safe because records are never
+// modified once they are read.
+//
+// If the writer has a marker, it reports discarded records in-band: the next
+// record it accepts is preceded by a marker describing what was discarded.
+//
+// With the spill policy, records that don't fit in memory are appended to a
+// queue on disk instead. Once anything has spilled, every record spills until
+// the disk queue is drained, so records are still written in order.
+//
+// The writer is a record.Tracker: a record has left it once it has been
+// written out, discarded, or stored on disk.
+type QueueWriter struct {
+	sync.Mutex
+	cond     *sync.Cond
+	w        record.Writer
+	max      int // Capacity of the queue, in bytes.
+	overflow Overflow
+	marker   MarkerFunc
+	spill    *spillQueue // nil unless the overflow policy is OverflowSpill.
+
+	recs []*record.Record
+	size int            // Bytes queued, including the record being written.
+	busy bool           // A record is being written.
+	cur  *record.Record // Record from memory being written; nil if none.
+	err  error
+
+	// Callbacks waiting for a record in memory to leave the queue, keyed by
+	// that record.
+	trackers map[*record.Record][]func(ok bool)
+
+	dropped dropCount // Data discarded since the last marker was queued.
+}
+
+// NewQueueWriter creates a QueueWriter whose queue holds up to max bytes.
+func NewQueueWriter(w record.Writer, max int, overflow Overflow) *QueueWriter {
+	qw := &QueueWriter{
+		w:        w,
+		max:      max,
+		overflow: overflow,
+		trackers: map[*record.Record][]func(ok bool){},
+	}
+	qw.cond = sync.NewCond(&qw.Mutex)
+
+	go qw.drain()
+
+	return qw
+}
+
+// SetMarker configures the writer to report discarded records with markers
+// built by the given function.
+func (qw *QueueWriter) SetMarker(m MarkerFunc) {
+	qw.marker = m
+}
+
+// SetSpill configures the writer to spill records to a disk queue in the
+// given directory, holding up to max bytes; 0 means no limit. Records left in
+// the directory by an earlier run are written before any new ones.
+func (qw *QueueWriter) SetSpill(dir string, max int64) error {
+	sq, err := openSpillQueue(dir, max)
+	if err != nil {
+		return err
+	}
+
+	qw.Lock()
+	qw.spill = sq
+	qw.cond.Broadcast()
+	qw.Unlock()
+
+	return nil
+}
+
+// WriteRecord adds a record to the queue. If the queue is full, it applies
+// the queue's overflow policy. A record larger than the whole queue is
+// accepted once the queue is empty. It returns the error that stopped the
+// queue, if any.
+func (qw *QueueWriter) WriteRecord(rec *record.Record) error {
+	qw.Lock()
+	defer qw.Unlock()
+
+	if qw.err != nil {
+		return qw.err
+	}
+
+	n := recordSize(rec)
+	if qw.overflow == OverflowSpill && (!qw.spill.empty() || qw.full(n)) {
+		return qw.writeSpill(rec)
+	}
+
+	if !qw.makeRoom(n) {
+		qw.drop(rec)
+		return nil
+	}
+	if qw.err != nil {
+		return qw.err
+	}
+
+	// Report earlier discards before the record that follows them.
+	if m := qw.pendingMarker(rec); m != nil {
+		qw.push(m)
+		qw.dropped.reset()
+	}
+
+	qw.push(rec)
+	qw.cond.Broadcast()
+
+	return nil
+}
+
+// Track arranges for done to be called once every record written so far has
+// left the queue.
+func (qw *QueueWriter) Track(done func(ok bool)) {
+	qw.Lock()
+	defer qw.Unlock()
+
+	if qw.err != nil {
+		done(false)
+		return
+	}
+
+	// Records on disk have already left the queue, as far as the caller is
+	// concerned. The newest record in memory is the last to leave it.
+	last := qw.cur
+	if len(qw.recs) > 0 {
+		last = qw.recs[len(qw.recs)-1]
+	}
+	if last == nil {
+		done(true)
+		return
+	}
+
+	qw.trackers[last] = append(qw.trackers[last], done)
+}
+
+// untrack removes and returns the callbacks waiting for the given record. The
+// caller must hold the lock.
+func (qw *QueueWriter) untrack(rec *record.Record) []func(ok bool) {
+	done := qw.trackers[rec]
+	delete(qw.trackers, rec)
+	return done
+}
+
+// untrackAll removes and returns every callback. The caller must hold the
+// lock.
+func (qw *QueueWriter) untrackAll() []func(ok bool) {
+	var done []func(ok bool)
+	for rec, d := range qw.trackers {
+		done = append(done, d...)
+		delete(qw.trackers, rec)
+	}
+	return done
+}
+
+// writeSpill appends a record to the disk queue, preceded by a marker if
+// earlier records were discarded. If the disk queue is full, the record is
+// discarded. The caller must hold the lock.
+func (qw *QueueWriter) writeSpill(rec *record.Record) error {
+	recs := []*record.Record{rec}
+	if m := qw.pendingMarker(rec); m != nil {
+		recs = []*record.Record{m, rec}
+	}
+
+	if !qw.spill.fits(recs) {
+		qw.drop(rec)
+		return nil
+	}
+
+	err := qw.spill.push(recs)
+	if err != nil {
+		qw.err = err
+		qw.cond.Broadcast()
+		return err
+	}
+
+	qw.dropped.reset()
+	qw.cond.Broadcast()
+
+	return nil
+}
+
+// Save moves the records in memory, including the one being written, to the
+// disk queue and writes its cursor, so that the next rex to use the spill
+// directory writes them. It stops the queue. Without a spill directory, it
+// does nothing: the records in memory are lost, and are never reported as
+// having left the queue.
+func (qw *QueueWriter) Save() error {
+	qw.Lock()
+	defer qw.Unlock()
+
+	if qw.spill == nil || qw.err != nil {
+		return nil
+	}
+
+	// The record being written might not make it, so it is saved too; it
+	// may be written twice. Records in memory are older than those on
+	// disk.
+	recs := qw.recs
+	if qw.cur != nil {
+		recs = append([]*record.Record{qw.cur}, recs...)
+	}
+
+	err := qw.spill.prepend(recs)
+	if err == nil {
+		qw.recs = nil
+		qw.size = 0
+		err = qw.spill.sync()
+	}
+
+	qw.err = errQueueSaved
+	qw.cond.Broadcast()
+
+	for _, d := range qw.untrackAll() {
+		d(err == nil)
+	}
+
+	return err
+}
+
+// Close stops the queue: its goroutine exits once the record being written,
+// if any, has been written. Records still in memory are lost, and are never
+// reported as having left the queue. Records on disk stay there for a later
+// run.
+func (qw *QueueWriter) Close() error {
+	qw.Lock()
+	defer qw.Unlock()
+
+	if qw.err == nil {
+		qw.err = errQueueClosed
+	}
+	qw.cond.Broadcast()
+
+	for _, d := range qw.untrackAll() {
+		d(false)
+	}
+
+	if qw.spill == nil {
+		return nil
+	}
+	return qw.spill.close()
+}
+
+// pendingMarker returns a marker record reporting the records discarded since
+// the last marker, or nil if there is nothing to report. The caller must hold
+// the lock.
+func (qw *QueueWriter) pendingMarker(rec *record.Record) *record.Record {
+	if qw.marker == nil || !qw.dropped.any() {
+		return nil
+	}
+
+	return &record.Record{
+		Data:   qw.dropped.marker(qw.marker),
+		Source: rec.Source,
+	}
+}
+
+// full reports whether a record of n bytes doesn't fit in the in-memory
+// queue. A record larger than the whole queue fits once the queue is empty.
+// The caller must hold the lock.
+func (qw *QueueWriter) full(n int) bool {
+	return qw.size > 0 && qw.size+n > qw.max
+}
+
+// makeRoom applies the overflow policy until n more bytes fit in the queue.
+// It returns false if the incoming record should be discarded instead. The
+// caller must hold the lock.
+func (qw *QueueWriter) makeRoom(n int) bool {
+	switch qw.overflow {
+	case OverflowBlock:
+		for qw.err == nil && qw.full(n) {
+			qw.cond.Wait()
+		}
+		return true
+
+	case OverflowDropNewest:
+		return !qw.full(n)
+
+	case OverflowDropOldest:
+		// The record being written is no longer in the queue, so it can't
+		// be discarded.
+		for qw.full(n) && len(qw.recs) > 0 {
+			old := qw.recs[0]
+			qw.recs[0] = nil
+			qw.recs = qw.recs[1:]
+			qw.size -= recordSize(old)
+			qw.drop(old)
+
+			// Whatever waited for the discarded record now waits for
+			// the record being written, which precedes it.
+			done := qw.untrack(old)
+			if qw.cur != nil {
+				qw.trackers[qw.cur] = append(qw.trackers[qw.cur], done...)
+			} else {
+				for _, d := range done {
+					d(true)
+				}
+			}
+		}
+		return true
+
+	case OverflowSpill:
+		// The caller spills the record if it doesn't fit.
+		return true
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid overflow policy: %v", qw.overflow))
+	}
+}
+
+// push appends a record to the queue. The caller must hold the lock.
+func (qw *QueueWriter) push(rec *record.Record) {
+	qw.recs = append(qw.recs, rec)
+	qw.size += recordSize(rec)
+}
+
+// drop records that the given record was discarded. The caller must hold the
+// lock.
+func (qw *QueueWriter) drop(rec *record.Record) {
+	qw.dropped.add(rec)
+}
+
+// Flush waits for the queue to drain, then flushes the underlying writer if
+// it retains data between writes.
+func (qw *QueueWriter) Flush() error {
+	qw.Lock()
+	for qw.err == nil && (qw.pending() || qw.busy) {
+		qw.cond.Wait()
+	}
+	err := qw.err
+	qw.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return flush(qw.w)
+}
+
+// pending reports whether any records are waiting to be written, in memory
+// or on disk. The caller must hold the lock.
+func (qw *QueueWriter) pending() bool {
+	return len(qw.recs) > 0 || (qw.spill != nil && !qw.spill.empty())
+}
+
+// drain writes queued records to the underlying writer until a write fails.
+// Records in memory are always older than those on disk, so they are written
+// first.
+func (qw *QueueWriter) drain() {
+	for {
+		qw.Lock()
+		for qw.err == nil && !qw.pending() {
+			qw.cond.Wait()
+		}
+		if qw.err != nil {
+			qw.Unlock()
+			return
+		}
+
+		var rec *record.Record
+		spilled := len(qw.recs) == 0
+		if spilled {
+			var err error
+			rec, err = qw.spill.pop()
+			if err != nil {
+				qw.err = err
+				qw.cond.Broadcast()
+				qw.Unlock()
+				return
+			}
+		} else {
+			rec = qw.recs[0]
+			qw.recs[0] = nil
+			qw.recs = qw.recs[1:]
+			qw.cur = rec
+		}
+		qw.busy = true
+		qw.Unlock()
+
+		err := qw.w.WriteRecord(rec)
+
+		qw.Lock()
+		qw.busy = false
+		qw.cur = nil
+		if qw.err == errQueueSaved || qw.err == errQueueClosed {
+			// The queue was saved or closed while the record was being
+			// written.
+			qw.cond.Broadcast()
+			qw.Unlock()
+			return
+		}
+		if spilled {
+			if err == nil {
+				err = qw.spill.ack()
+			}
+		} else {
+			qw.size -= recordSize(rec)
+		}
+
+		done := qw.untrack(rec)
+		ok := err == nil
+		if err != nil {
+			// Records saved to disk have left the queue as surely as
+			// written ones; the others are lost.
+			qw.err = err
+			if qw.spill != nil {
+				saveErr := qw.save(rec, spilled)
+				qw.err = errors.Join(err, saveErr)
+				ok = saveErr == nil
+			}
+			done = append(done, qw.untrackAll()...)
+		}
+		qw.cond.Broadcast()
+		qw.Unlock()
+
+		for _, d := range done {
+			d(ok)
+		}
+	}
+}
+
+// save moves the records that were never written from memory to the disk
+// queue, so that they are written by the next rex to use the spill directory.
+// rec is the record whose write failed; if it came from disk, it is already
+// there. The caller must hold the lock.
+func (qw *QueueWriter) save(rec *record.Record, spilled bool) error {
+	var err error
+	if spilled {
+		// The in-memory records arrived after the failed record was
+		// spilled, so they belong after it.
+		err = qw.spill.push(qw.recs)
+	} else {
+		// The disk queue is only read once memory is empty, so everything
+		// on disk arrived after the failed record.
+		err = qw.spill.prepend(append([]*record.Record{rec}, qw.recs...))
+	}
+	if err != nil {
+		return err
+	}
+
+	qw.recs = nil
+	qw.size = 0
+
+	return qw.spill.sync()
+}
+
+// recordSize returns the number of bytes a record occupies in a queue.
+func recordSize(rec *record.Record) int {
+	return rec.Size()
+}
+
+// QueuedWriter implements record.Writer. It writes to a chain of writers that
+// ends in a QueueWriter, and gives access to the queue: records are tracked
+// through it, once the writers of the chain that retain data have let go of
+// them, and it is saved when the chain is.
+type QueuedWriter struct {
+	w record.Writer
+	q *QueueWriter
+}
+
+// NewQueuedWriter creates a QueuedWriter that writes to w, whose chain ends in
+// q.
+func NewQueuedWriter(w record.Writer, q *QueueWriter) *QueuedWriter {
+	return &QueuedWriter{
+		w: w,
+		q: q,
+	}
+}
+
+func (qw *QueuedWriter) WriteRecord(rec *record.Record) error {
+	return qw.w.WriteRecord(rec)
+}
+
+func (qw *QueuedWriter) Track(done func(ok bool)) {
+	// The chain may consist of the queue alone.
+	if qw.w == qw.q {
+		qw.q.Track(done)
+		return
+	}
+
+	record.Track(qw.w, func(ok bool) {
+		if !ok {
+			done(false)
+			return
+		}
+		qw.q.Track(done)
+	})
+}
+
+func (qw *QueuedWriter) Save() error {
+	return qw.q.Save()
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (qw *QueuedWriter) Flush() error {
+	return flush(qw.w)
+}
+
+// flush flushes w if it is a record.Flusher.
+func flush(w record.Writer) error {
+	if f, ok := w.(record.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// save saves w if it is a Saver.
+func save(w record.Writer) error {
+	if s, ok := w.(Saver); ok {
+		return s.Save()
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// RateLimit specifies what a RateWriter does with records that exceed its
+// limits.
+type RateLimit int
+
+const (
+	RateDrop   RateLimit = iota // Discard the record.
+	RateDelay                   // Wait until the record is within the limits.
+	RateSample                  // Forward a share of records matching the limits.
+)
+
+// tokenBucket limits a rate of consumption. It holds up to one second's worth
+// of tokens, and refills continuously.
+type tokenBucket struct {
+	rate   float64 // Tokens per second.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accrued since the last refill.
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+}
+
+// ready reports whether n tokens may be taken. More tokens than the bucket
+// holds may be taken once it is full; the bucket then goes into debt.
+func (tb *tokenBucket) ready(n float64) bool {
+	return tb.tokens >= n || tb.tokens >= tb.rate
+}
+
+// wait returns how long it takes until n tokens may be taken.
+func (tb *tokenBucket) wait(n float64) time.Duration {
+	if tb.ready(n) {
+		return 0
+	}
+
+	need := n
+	if need > tb.rate {
+		need = tb.rate
+	}
+	return time.Duration((need - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// RateWriter implements record.Writer. It limits the rate of data written to
+// the underlying writer, in bytes per second, records per second, or both.
+// Records that exceed the limits are discarded, delayed, or sampled,
+// depending on the writer's policy.
+//
+// Sampling forwards records evenly throughout each second, rather than the
+// first records of each second as dropping does. Each second, it forwards the
+// share of records that would have kept the previous second within the
+// limits. The limits still apply on top of that, to cap bursts.
+//
+// If the writer has a marker, it reports discarded records in-band: the next
+// record it forwards is preceded by a marker describing what was discarded.
+type RateWriter struct {
+	w      record.Writer
+	policy RateLimit
+	marker MarkerFunc
+	split  bool // Whether each record written is a whole record.
+
+	byteBucket *tokenBucket // nil if bytes are not limited.
+	lineBucket *tokenBucket // nil if records are not limited.
+
+	// Sampling state.
+	window      time.Time // Start of the current one-second window.
+	windowBytes int       // Bytes offered during the current window.
+	windowLines int       // Records offered during the current window.
+	share       float64   // Share of records to forward in this window.
+	credit      float64   // Accumulated share, forwarded once it reaches 1.
+
+	dropped dropCount // Data discarded since the last marker was written.
+}
+
+// NewRateWriter creates a RateWriter that forwards up to byteRate bytes and
+// lineRate records per second; 0 means no limit. Unless the data written is
+// split into records, it counts one record per line.
+func NewRateWriter(w record.Writer, byteRate int, lineRate int, policy RateLimit, split bool) *RateWriter {
+	rw := &RateWriter{
+		w:      w,
+		policy: policy,
+		split:  split,
+		window: time.Now(),
+		share:  1,
+	}
+	if byteRate > 0 {
+		rw.byteBucket = newTokenBucket(byteRate)
+	}
+	if lineRate > 0 {
+		rw.lineBucket = newTokenBucket(lineRate)
+	}
+
+	return rw
+}
+
+// SetMarker configures the writer to report discarded records with markers
+// built by the given function.
+func (rw *RateWriter) SetMarker(m MarkerFunc) {
+	rw.marker = m
+}
+
+func (rw *RateWriter) WriteRecord(rec *record.Record) error {
+	n := float64(recordSize(rec))
+	lines := float64(rw.lines(rec))
+	now := time.Now()
+
+	switch rw.policy {
+	case RateDrop:
+		rw.refill(now)
+		if !rw.ready(n, lines) {
+			rw.drop(rec)
+			return nil
+		}
+		rw.take(n, lines)
+
+	case RateDelay:
+		rw.refill(now)
+		for !rw.ready(n, lines) {
+			time.Sleep(rw.wait(n, lines))
+			rw.refill(time.Now())
+		}
+		rw.take(n, lines)
+
+	case RateSample:
+		// The share is based on the previous second, so the limits still
+		// apply, to cap sudden bursts.
+		rw.refill(now)
+		if !rw.sample(now, n, lines) || !rw.ready(n, lines) {
+			rw.drop(rec)
+			return nil
+		}
+		rw.take(n, lines)
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid rate limit policy: %v", rw.policy))
+	}
+
+	// Report earlier discards before the record that follows them.
+	if rw.marker != nil && rw.dropped.any() {
+		err := rw.w.WriteRecord(&record.Record{
+			Data:   rw.dropped.marker(rw.marker),
+			Source: rec.Source,
+		})
+		if err != nil {
+			return err
+		}
+		rw.dropped.reset()
+	}
+
+	return rw.w.WriteRecord(rec)
+}
+
+// lines returns the number of records a record counts as. A record split off
+// by the destination's framing counts as one; unsplit data counts as many as
+// it has lines.
+func (rw *RateWriter) lines(rec *record.Record) int {
+	if rw.split {
+		return 1
+	}
+	return bytes.Count(rec.Data, []byte{'\n'})
+}
+
+func (rw *RateWriter) refill(now time.Time) {
+	if rw.byteBucket != nil {
+		rw.byteBucket.refill(now)
+	}
+	if rw.lineBucket != nil {
+		rw.lineBucket.refill(now)
+	}
+}
+
+func (rw *RateWriter) ready(n float64, lines float64) bool {
+	return (rw.byteBucket == nil || rw.byteBucket.ready(n)) &&
+		(rw.lineBucket == nil || rw.lineBucket.ready(lines))
+}
+
+func (rw *RateWriter) wait(n float64, lines float64) time.Duration {
+	var d time.Duration
+	if rw.byteBucket != nil {
+		d = rw.byteBucket.wait(n)
+	}
+	if rw.lineBucket != nil {
+		if ld := rw.lineBucket.wait(lines); ld > d {
+			d = ld
+		}
+	}
+	return d
+}
+
+func (rw *RateWriter) take(n float64, lines float64) {
+	if rw.byteBucket != nil {
+		rw.byteBucket.tokens -= n
+	}
+	if rw.lineBucket != nil {
+		rw.lineBucket.tokens -= lines
+	}
+}
+
+// sample decides whether to forward a record under the sampling policy.
+func (rw *RateWriter) sample(now time.Time, n float64, lines float64) bool {
+	if now.Sub(rw.window) >= time.Second {
+		// Base this window's share on the traffic of the last one.
+		rw.share = 1
+		if rw.byteBucket != nil && rw.windowBytes > 0 {
+			rw.share = min(rw.share, rw.byteBucket.rate/float64(rw.windowBytes))
+		}
+		if rw.lineBucket != nil && rw.windowLines > 0 {
+			rw.share = min(rw.share, rw.lineBucket.rate/float64(rw.windowLines))
+		}
+
+		rw.window = now
+		rw.windowBytes = 0
+		rw.windowLines = 0
+	}
+
+	rw.windowBytes += int(n)
+	rw.windowLines += int(lines)
+
+	rw.credit += rw.share
+	if rw.credit < 1 {
+		return false
+	}
+	rw.credit--
+	return true
+}
+
+// drop records that the given record was discarded.
+func (rw *RateWriter) drop(rec *record.Record) {
+	rw.dropped.add(rec)
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (rw *RateWriter) Flush() error {
+	return flush(rw.w)
+}
@@ -0,0 +1,78 @@
+package output
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// reconnectPollInterval is how often a ReconnectWriter checks for a reader
+// while it waits for one.
+const reconnectPollInterval = 100 * time.Millisecond
+
+// ReconnectWriter implements io.Writer. It writes to a named pipe whose
+// readers come and go. It opens the pipe only once a reader is attached, so
+// that a reader never receives data written before it attached. When the
+// reader goes away, the writer closes the pipe and waits for the next one.
+//
+// While no reader is attached, a dropping writer discards data; any other
+// writer waits for a reader.
+type ReconnectWriter struct {
+	// open opens the pipe for writing, failing with ENXIO if it has no
+	// reader.
+	open func() (io.WriteCloser, error)
+	drop bool
+
+	w io.WriteCloser // nil while no reader is attached.
+}
+
+func NewReconnectWriter(open func() (io.WriteCloser, error), drop bool) *ReconnectWriter {
+	return &ReconnectWriter{
+		open: open,
+		drop: drop,
+	}
+}
+
+func (rw *ReconnectWriter) Write(b []byte) (int, error) {
+	for {
+		if rw.w == nil {
+			w, err := rw.open()
+			if errors.Is(err, syscall.ENXIO) {
+				if rw.drop {
+					return len(b), nil
+				}
+				time.Sleep(reconnectPollInterval)
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			rw.w = w
+		}
+
+		n, err := rw.w.Write(b)
+		if !errors.Is(err, syscall.EPIPE) {
+			return n, err
+		}
+
+		// The reader went away. Whatever it didn't receive goes to the next
+		// reader whole, unless it is discarded.
+		rw.w.Close()
+		rw.w = nil
+		if rw.drop {
+			return len(b), nil
+		}
+	}
+}
+
+// Close closes the pipe if it is open.
+func (rw *ReconnectWriter) Close() error {
+	if rw.w == nil {
+		return nil
+	}
+
+	err := rw.w.Close()
+	rw.w = nil
+	return err
+}
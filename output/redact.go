@@ -0,0 +1,106 @@
+package output
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/badvassal/rex/record"
+)
+
+// redactHMACLen is the number of bytes of a value's HMAC that replace it.
+const redactHMACLen = 8
+
+// RedactRule describes sensitive content: the matches of an expression, or
+// of its first submatch if it has any. Name labels the content in the
+// replacement; it may be empty.
+type RedactRule struct {
+	Name string
+	Re   *regexp.Regexp
+}
+
+// RedactWriter implements record.Writer. It replaces sensitive content in
+// each record before passing it on. By default, content is replaced with a
+// fixed mask such as `[REDACTED]` or `[REDACTED:email]`. With a key, it is
+// replaced with a truncated HMAC of the content instead, such as
+// `[email:1f0c93a8d2b7e641]`, so that equal values can still be correlated
+// without being revealed.
+type RedactWriter struct {
+	w     record.Writer
+	rules []RedactRule
+	key   []byte // nil to mask content.
+}
+
+// NewRedactWriter creates a RedactWriter. key may be nil.
+func NewRedactWriter(w record.Writer, rules []RedactRule, key []byte) *RedactWriter {
+	return &RedactWriter{
+		w:     w,
+		rules: rules,
+		key:   key,
+	}
+}
+
+func (rw *RedactWriter) WriteRecord(rec *record.Record) error {
+	data := rec.Data
+	for _, rule := range rw.rules {
+		data = rw.redact(data, rule)
+	}
+
+	// Records are shared between destinations, so a redacted record is a
+	// new one.
+	r := *rec
+	r.Data = data
+	return rw.w.WriteRecord(&r)
+}
+
+// redact replaces the content matched by a rule.
+func (rw *RedactWriter) redact(b []byte, rule RedactRule) []byte {
+	matches := rule.Re.FindAllSubmatchIndex(b, -1)
+	if matches == nil {
+		return b
+	}
+
+	var out []byte
+	var last int
+	for _, m := range matches {
+		// Replace the first submatch, if there is one and it matched.
+		start, end := m[0], m[1]
+		if len(m) > 2 {
+			if m[2] < 0 {
+				continue
+			}
+			start, end = m[2], m[3]
+		}
+
+		out = append(out, b[last:start]...)
+		out = append(out, rw.replacement(b[start:end], rule.Name)...)
+		last = end
+	}
+
+	return append(out, b[last:]...)
+}
+
+// replacement returns what replaces the given content.
+func (rw *RedactWriter) replacement(value []byte, name string) []byte {
+	if rw.key == nil {
+		if name == "" {
+			return []byte("[REDACTED]")
+		}
+		return []byte("[REDACTED:" + name + "]")
+	}
+
+	mac := hmac.New(sha256.New, rw.key)
+	mac.Write(value)
+	sum := hex.EncodeToString(mac.Sum(nil)[:redactHMACLen])
+
+	if name == "" {
+		return []byte("[" + sum + "]")
+	}
+	return []byte("[" + name + ":" + sum + "]")
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (rw *RedactWriter) Flush() error {
+	return flush(rw.w)
+}
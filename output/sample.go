@@ -0,0 +1,159 @@
+package output
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// Sampling specifies which records a SampleWriter forwards. Exactly one of
+// its modes is set.
+type Sampling struct {
+	Every   int           // Forward one record in Every.
+	Percent float64       // Forward each record with this probability, in percent.
+	First   int           // Forward the first First records of each period.
+	Per     time.Duration // The period for First.
+}
+
+// SampleWriter implements record.Writer. It forwards a sample of the records
+// written to it and discards the rest.
+//
+// If the writer has a key, records are sampled by key rather than
+// individually: records whose keys are equal are either all forwarded or all
+// discarded, so related records are kept together. The key of a record is the
+// first submatch of the key expression, or the whole match if it has no
+// submatches. Records that don't match are sampled individually.
+type SampleWriter struct {
+	w   record.Writer
+	s   Sampling
+	key *regexp.Regexp // nil if records are sampled individually.
+
+	count int // Records seen, for one-in-N sampling.
+
+	// Head sampling state.
+	periodStart time.Time
+	periodCount int             // Records forwarded this period.
+	periodKeys  map[string]bool // Keys admitted this period.
+}
+
+// NewSampleWriter creates a SampleWriter. key may be nil.
+func NewSampleWriter(w record.Writer, s Sampling, key *regexp.Regexp) *SampleWriter {
+	return &SampleWriter{
+		w:          w,
+		s:          s,
+		key:        key,
+		periodKeys: map[string]bool{},
+	}
+}
+
+func (sw *SampleWriter) WriteRecord(rec *record.Record) error {
+	var keep bool
+	if key, ok := sw.recordKey(rec); ok {
+		keep = sw.keepKey(key)
+	} else {
+		keep = sw.keep()
+	}
+
+	if !keep {
+		return nil
+	}
+	return sw.w.WriteRecord(rec)
+}
+
+// recordKey extracts a record's sampling key. It returns false if the writer
+// has no key expression or the record doesn't match it.
+func (sw *SampleWriter) recordKey(rec *record.Record) (string, bool) {
+	if sw.key == nil {
+		return "", false
+	}
+
+	m := sw.key.FindSubmatch(rec.Data)
+	if m == nil {
+		return "", false
+	}
+	if len(m) > 1 {
+		return string(m[1]), true
+	}
+	return string(m[0]), true
+}
+
+// keep decides whether to forward a record that has no key.
+func (sw *SampleWriter) keep() bool {
+	switch {
+	case sw.s.Every > 0:
+		sw.count++
+		return (sw.count-1)%sw.s.Every == 0
+
+	case sw.s.First > 0:
+		sw.nextPeriod()
+		if sw.periodCount >= sw.s.First {
+			return false
+		}
+		sw.periodCount++
+		return true
+
+	default:
+		return rand.Float64()*100 < sw.s.Percent
+	}
+}
+
+// keepKey decides whether to forward a record with the given key. The
+// decision is the same for every record with that key, at least within a
+// period when head sampling.
+func (sw *SampleWriter) keepKey(key string) bool {
+	switch {
+	case sw.s.Every > 0:
+		return hashKey(key)%uint64(sw.s.Every) == 0
+
+	case sw.s.First > 0:
+		sw.nextPeriod()
+		if sw.periodKeys[key] {
+			return true
+		}
+		if len(sw.periodKeys) >= sw.s.First {
+			return false
+		}
+		sw.periodKeys[key] = true
+		return true
+
+	default:
+		return float64(hashKey(key))/math.MaxUint64*100 < sw.s.Percent
+	}
+}
+
+// nextPeriod starts a new head sampling period if the current one is over.
+func (sw *SampleWriter) nextPeriod() {
+	now := time.Now()
+	if now.Sub(sw.periodStart) < sw.s.Per {
+		return
+	}
+
+	sw.periodStart = now
+	sw.periodCount = 0
+	sw.periodKeys = map[string]bool{}
+}
+
+// hashKey maps a sampling key to a uniformly distributed number. FNV alone
+// leaves the high bits of similar short keys close together, so its result
+// is mixed further with MurmurHash3's finalizer.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (sw *SampleWriter) Flush() error {
+	return flush(sw.w)
+}
@@ -0,0 +1,38 @@
+package output
+
+import (
+	"strconv"
+
+	"github.com/badvassal/rex/record"
+)
+
+// SeqWriter implements record.Writer. It prefixes each record with a
+// sequence number, so that consumers can detect records that were lost on the
+// way to them.
+type SeqWriter struct {
+	w   record.Writer
+	seq uint64
+}
+
+func NewSeqWriter(w record.Writer) *SeqWriter {
+	return &SeqWriter{
+		w: w,
+	}
+}
+
+func (sw *SeqWriter) WriteRecord(rec *record.Record) error {
+	sw.seq++
+
+	data := strconv.AppendUint(nil, sw.seq, 10)
+	data = append(data, ' ')
+	data = append(data, rec.Data...)
+
+	r := *rec
+	r.Data = data
+	return sw.w.WriteRecord(&r)
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (sw *SeqWriter) Flush() error {
+	return flush(sw.w)
+}
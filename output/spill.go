@@ -0,0 +1,440 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+const (
+	// spillSegmentSize is the size beyond which a new spill segment is
+	// started.
+	spillSegmentSize = 16 * 1024 * 1024
+
+	// spillFirstSegment is the number of the first segment in an empty spill
+	// directory. Segments that must be read before it get lower numbers.
+	spillFirstSegment = 1 << 32
+
+	// spillCursorInterval is the minimum time between writes of the cursor
+	// file while records are being delivered.
+	spillCursorInterval = time.Second
+
+	spillSegmentExt = ".seg"
+	spillCursorName = "cursor"
+
+	// Each record on disk is preceded by its length.
+	spillHeaderLen = 4
+)
+
+// spillQueue is a segmented on-disk queue of records. Records are appended to
+// the newest segment and read from the oldest. A segment is deleted once all
+// of its records have been delivered. The position just past the last
+// delivered record is stored in a cursor file, so that undelivered records
+// survive a restart.
+//
+// At most one record may be read but not yet acknowledged at any time.
+type spillQueue struct {
+	dir    string
+	max    int64    // Maximum number of bytes on disk.
+	segs   []uint64 // Segment numbers, oldest first.
+	size   int64    // Bytes on disk, across all segments.
+	unread int64    // Bytes not yet read.
+
+	w     *os.File // Newest segment, open for appending.
+	wSize int64    // Size of the newest segment.
+
+	r    *bufio.Reader // Oldest segment, open for reading.
+	rf   *os.File
+	rSeg uint64
+	rOff int64 // Offset of the next record to read.
+
+	cursorSeg   uint64 // Position just past the last delivered record.
+	cursorOff   int64
+	cursorDirty bool
+	cursorSaved time.Time
+}
+
+// openSpillQueue opens the spill queue in the given directory, creating the
+// directory if necessary. Records left over from a previous run are read
+// first.
+func openSpillQueue(dir string, max int64) (*spillQueue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	sq := &spillQueue{
+		dir: dir,
+		max: max,
+	}
+
+	err = sq.scan()
+	if err != nil {
+		return nil, fmt.Errorf("spill %s: %w", dir, err)
+	}
+
+	return sq, nil
+}
+
+// scan discovers the segments in the spill directory and positions the queue
+// at the cursor.
+func (sq *spillQueue) scan() error {
+	entries, err := os.ReadDir(sq.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, spillSegmentExt) {
+			continue
+		}
+
+		var seg uint64
+		_, err := fmt.Sscanf(name, "%016x"+spillSegmentExt, &seg)
+		if err != nil {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+
+		sq.segs = append(sq.segs, seg)
+		sq.size += fi.Size()
+	}
+	sort.Slice(sq.segs, func(i, j int) bool { return sq.segs[i] < sq.segs[j] })
+
+	sq.unread = sq.size
+	if len(sq.segs) == 0 {
+		return nil
+	}
+
+	err = sq.loadCursor()
+	if err != nil {
+		return err
+	}
+
+	// Segments older than the cursor's have been fully delivered; the cursor
+	// only ever points into the oldest segment.
+	sq.rSeg = sq.segs[0]
+	if sq.cursorSeg == sq.rSeg {
+		sq.rOff = sq.cursorOff
+		sq.unread -= sq.cursorOff
+	}
+
+	return nil
+}
+
+// loadCursor reads the cursor file, if there is one.
+func (sq *spillQueue) loadCursor() error {
+	b, err := os.ReadFile(filepath.Join(sq.dir, spillCursorName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	_, err = fmt.Sscanf(string(b), "%x %d\n", &sq.cursorSeg, &sq.cursorOff)
+	if err != nil {
+		return fmt.Errorf("invalid cursor file: %w", err)
+	}
+
+	return nil
+}
+
+// empty reports whether every record on disk has been read.
+func (sq *spillQueue) empty() bool {
+	return sq.unread == 0
+}
+
+// segPath returns the path of the given segment.
+func (sq *spillQueue) segPath(seg uint64) string {
+	return filepath.Join(sq.dir, fmt.Sprintf("%016x%s", seg, spillSegmentExt))
+}
+
+// fits reports whether the given records fit in the queue without exceeding
+// its maximum size.
+func (sq *spillQueue) fits(recs []*record.Record) bool {
+	return sq.max == 0 || sq.size+encodedSize(recs) <= sq.max
+}
+
+// push appends records to the queue.
+func (sq *spillQueue) push(recs []*record.Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	if sq.w == nil || sq.wSize >= spillSegmentSize {
+		err := sq.startSegment()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := sq.w.Write(encode(recs))
+	if err != nil {
+		return err
+	}
+
+	n := encodedSize(recs)
+	sq.wSize += n
+	sq.size += n
+	sq.unread += n
+	return nil
+}
+
+// startSegment begins a new newest segment.
+func (sq *spillQueue) startSegment() error {
+	seg := uint64(spillFirstSegment)
+	if len(sq.segs) > 0 {
+		seg = sq.segs[len(sq.segs)-1] + 1
+	}
+
+	f, err := os.OpenFile(sq.segPath(seg), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if sq.w != nil {
+		sq.w.Close()
+	}
+	sq.w = f
+	sq.wSize = 0
+	sq.segs = append(sq.segs, seg)
+
+	if len(sq.segs) == 1 {
+		sq.rSeg = seg
+		sq.rOff = 0
+	}
+
+	return nil
+}
+
+// prepend stores records ahead of everything else in the queue. It is used to
+// save records that were taken out of memory but never delivered. It must not
+// be called once records have been read from the queue, unless the queue has
+// drained since.
+func (sq *spillQueue) prepend(recs []*record.Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	seg := uint64(spillFirstSegment)
+	if len(sq.segs) > 0 {
+		seg = sq.segs[0] - 1
+	}
+
+	err := os.WriteFile(sq.segPath(seg), encode(recs), 0644)
+	if err != nil {
+		return err
+	}
+
+	n := encodedSize(recs)
+	sq.size += n
+	sq.unread += n
+	sq.segs = append([]uint64{seg}, sq.segs...)
+	sq.rSeg = seg
+	sq.rOff = 0
+
+	return nil
+}
+
+// pop reads the oldest unread record. It must not be called while the queue
+// is empty or while the previously popped record is unacknowledged.
+func (sq *spillQueue) pop() (*record.Record, error) {
+	for {
+		if sq.r == nil {
+			f, err := os.Open(sq.segPath(sq.rSeg))
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = f.Seek(sq.rOff, io.SeekStart)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			sq.rf = f
+			sq.r = bufio.NewReader(f)
+		}
+
+		var hdr [spillHeaderLen]byte
+		_, err := io.ReadFull(sq.r, hdr[:])
+		if err == io.EOF && sq.rSeg != sq.segs[len(sq.segs)-1] {
+			// Finished an older segment. Continue with the next one.
+			err = sq.nextSegment()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("spill %s: corrupt segment %016x: %w", sq.dir, sq.rSeg, err)
+		}
+
+		b := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		_, err = io.ReadFull(sq.r, b)
+		if err != nil {
+			return nil, fmt.Errorf("spill %s: corrupt segment %016x: %w", sq.dir, sq.rSeg, err)
+		}
+
+		n := int64(spillHeaderLen + len(b))
+		sq.rOff += n
+		sq.unread -= n
+
+		return &record.Record{
+			Data: b,
+		}, nil
+	}
+}
+
+// nextSegment deletes the fully delivered oldest segment and starts reading
+// the next one.
+func (sq *spillQueue) nextSegment() error {
+	sq.rf.Close()
+	sq.rf = nil
+	sq.r = nil
+
+	err := os.Remove(sq.segPath(sq.rSeg))
+	if err != nil {
+		return err
+	}
+
+	sq.size -= sq.rOff
+	sq.segs = sq.segs[1:]
+	sq.rSeg = sq.segs[0]
+	sq.rOff = 0
+
+	sq.cursorSeg = sq.rSeg
+	sq.cursorOff = 0
+	return sq.saveCursor()
+}
+
+// ack records that the most recently popped record has been delivered. Once
+// everything on disk has been delivered, the segments are discarded.
+func (sq *spillQueue) ack() error {
+	sq.cursorSeg = sq.rSeg
+	sq.cursorOff = sq.rOff
+	sq.cursorDirty = true
+
+	if sq.empty() {
+		return sq.reset()
+	}
+
+	if time.Since(sq.cursorSaved) < spillCursorInterval {
+		return nil
+	}
+	return sq.saveCursor()
+}
+
+// reset discards all segments. It is called once everything on disk has been
+// delivered.
+func (sq *spillQueue) reset() error {
+	if sq.rf != nil {
+		sq.rf.Close()
+		sq.rf = nil
+		sq.r = nil
+	}
+	if sq.w != nil {
+		sq.w.Close()
+		sq.w = nil
+	}
+
+	for _, seg := range sq.segs {
+		err := os.Remove(sq.segPath(seg))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	sq.segs = nil
+	sq.size = 0
+	sq.unread = 0
+	sq.rOff = 0
+
+	err := os.Remove(filepath.Join(sq.dir, spillCursorName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	sq.cursorDirty = false
+	return nil
+}
+
+// saveCursor writes the cursor file. It writes to a temporary file first so
+// that a crash never leaves a partially written cursor behind.
+func (sq *spillQueue) saveCursor() error {
+	path := filepath.Join(sq.dir, spillCursorName)
+	tmp := path + ".tmp"
+
+	err := os.WriteFile(tmp, []byte(fmt.Sprintf("%x %d\n", sq.cursorSeg, sq.cursorOff)), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	sq.cursorDirty = false
+	sq.cursorSaved = time.Now()
+	return nil
+}
+
+// close writes the cursor file if it is out of date, and closes the segment
+// files. The queue must not be used afterwards.
+func (sq *spillQueue) close() error {
+	err := sq.sync()
+
+	if sq.rf != nil {
+		sq.rf.Close()
+		sq.rf = nil
+		sq.r = nil
+	}
+	if sq.w != nil {
+		sq.w.Close()
+		sq.w = nil
+	}
+
+	return err
+}
+
+// sync writes the cursor file if it is out of date.
+func (sq *spillQueue) sync() error {
+	if !sq.cursorDirty {
+		return nil
+	}
+	return sq.saveCursor()
+}
+
+// encode returns the on-disk representation of the given records.
+func encode(recs []*record.Record) []byte {
+	buf := make([]byte, 0, encodedSize(recs))
+	for _, rec := range recs {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(recordSize(rec)))
+		buf = rec.AppendTo(buf)
+	}
+	return buf
+}
+
+// encodedSize returns the number of bytes the given records occupy on disk.
+func encodedSize(recs []*record.Record) int64 {
+	var n int64
+	for _, rec := range recs {
+		n += int64(spillHeaderLen + recordSize(rec))
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// TimestampFormat specifies how a StampWriter formats timestamps.
+type TimestampFormat int
+
+const (
+	TimestampNone        TimestampFormat = iota // No timestamp.
+	TimestampRFC3339Nano                        // RFC 3339 with nanoseconds, e.g. 2006-01-02T15:04:05.999999999Z07:00.
+	TimestampUnix                               // Seconds since the Unix epoch, e.g. 1136214245.999999.
+	TimestampMono                               // Seconds since rex started, from a monotonic clock, e.g. 12.345678.
+)
+
+// startTime is when rex started. Monotonic timestamps are relative to it.
+var startTime = time.Now()
+
+// StampWriter implements record.Writer. It prefixes each record with the time
+// rex read it, a fixed tag, or both, each followed by a space. Since the
+// timestamp is the record's read time rather than the time of the write, every
+// destination stamps a record the same way.
+type StampWriter struct {
+	w      record.Writer
+	format TimestampFormat
+	prefix string
+}
+
+// NewStampWriter creates a StampWriter. prefix may be empty.
+func NewStampWriter(w record.Writer, format TimestampFormat, prefix string) *StampWriter {
+	return &StampWriter{
+		w:      w,
+		format: format,
+		prefix: prefix,
+	}
+}
+
+func (sw *StampWriter) WriteRecord(rec *record.Record) error {
+	var data []byte
+	if sw.format != TimestampNone {
+		data = sw.appendTime(data, rec.Time)
+		data = append(data, ' ')
+	}
+	if sw.prefix != "" {
+		data = append(data, sw.prefix...)
+		data = append(data, ' ')
+	}
+	data = append(data, rec.Data...)
+
+	r := *rec
+	r.Data = data
+	return sw.w.WriteRecord(&r)
+}
+
+// appendTime appends the formatted timestamp t to b. A record that rex did
+// not read itself is stamped with the current time.
+func (sw *StampWriter) appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	switch sw.format {
+	case TimestampRFC3339Nano:
+		return t.AppendFormat(b, time.RFC3339Nano)
+
+	case TimestampUnix:
+		us := t.UnixMicro()
+		return fmt.Appendf(b, "%d.%06d", us/1e6, us%1e6)
+
+	case TimestampMono:
+		us := t.Sub(startTime).Microseconds()
+		return fmt.Appendf(b, "%d.%06d", us/1e6, us%1e6)
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid timestamp format: %v", sw.format))
+	}
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (sw *StampWriter) Flush() error {
+	return flush(sw.w)
+}
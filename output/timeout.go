@@ -0,0 +1,214 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// TimeoutMode specifies what a TimeoutWriter does while its destination is
+// degraded.
+type TimeoutMode int
+
+const (
+	TimeoutDrop TimeoutMode = iota // Discard records.
+	TimeoutWait                    // Wait for the destination to recover.
+	TimeoutFail                    // Fail with ErrTimeout.
+)
+
+// ErrTimeout is the error a failing TimeoutWriter returns when a write times
+// out, and for every write until its destination recovers.
+var ErrTimeout = errors.New("write timed out")
+
+// errTimeoutClosed is the error a TimeoutWriter returns once it has been
+// closed.
+var errTimeoutClosed = errors.New("timeout writer closed")
+
+// TimeoutWriter implements record.Writer. It limits how long a write to the
+// underlying writer may take. When a write doesn't complete in time, the
+// writer reports success and considers its destination degraded until that
+// write completes. A write to a hung destination can't be abandoned, so the
+// writer can't retry the destination any sooner.
+//
+// What a degraded writer does depends on its mode. A writer that waits blocks
+// until its destination recovers, so it must sit behind a queue that spills
+// to disk: the queue's goroutine waits, and the rest of rex carries on. A
+// writer that fails lets its caller send records elsewhere. State
+// transitions are logged to stderr.
+//
+// If the writer has a marker, it reports discarded records in-band: the first
+// record it writes after recovering is preceded by a marker describing what
+// was discarded.
+type TimeoutWriter struct {
+	w       record.Writer
+	name    string
+	timeout time.Duration
+	mode    TimeoutMode
+	marker  MarkerFunc
+
+	reqs    chan *record.Record
+	results chan error
+	closed  chan struct{} // Closed to stop the writer's goroutine.
+
+	degraded time.Time // Zero unless a write has timed out.
+
+	dropped dropCount // Data discarded while the writer was degraded.
+}
+
+// NewTimeoutWriter creates a TimeoutWriter for the named destination.
+func NewTimeoutWriter(w record.Writer, name string, timeout time.Duration, mode TimeoutMode) *TimeoutWriter {
+	tw := &TimeoutWriter{
+		w:       w,
+		name:    name,
+		timeout: timeout,
+		mode:    mode,
+		reqs:    make(chan *record.Record),
+		results: make(chan error, 1),
+		closed:  make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case rec := <-tw.reqs:
+				tw.results <- tw.w.WriteRecord(rec)
+			case <-tw.closed:
+				return
+			}
+		}
+	}()
+
+	return tw
+}
+
+// SetMarker configures the writer to report discarded records with markers
+// built by the given function.
+func (tw *TimeoutWriter) SetMarker(m MarkerFunc) {
+	tw.marker = m
+}
+
+func (tw *TimeoutWriter) WriteRecord(rec *record.Record) error {
+	if !tw.degraded.IsZero() {
+		var err error
+		if tw.mode == TimeoutWait {
+			select {
+			case err = <-tw.results:
+			case <-tw.closed:
+				return errTimeoutClosed
+			}
+		} else {
+			select {
+			case err = <-tw.results:
+			default:
+				if tw.mode == TimeoutFail {
+					return ErrTimeout
+				}
+				tw.dropped.add(rec)
+				return nil
+			}
+		}
+
+		err = tw.recover(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tw.marker != nil && tw.dropped.any() {
+		m := tw.dropped.marker(tw.marker)
+		tw.dropped.reset()
+
+		err := tw.write(&record.Record{
+			Data:   m,
+			Source: rec.Source,
+		})
+		if err != nil || !tw.degraded.IsZero() {
+			tw.dropped.add(rec)
+			return err
+		}
+	}
+
+	return tw.write(rec)
+}
+
+// write writes a record to the underlying writer, giving up on it once the
+// timeout elapses.
+func (tw *TimeoutWriter) write(rec *record.Record) error {
+	select {
+	case tw.reqs <- rec:
+	case <-tw.closed:
+		return errTimeoutClosed
+	}
+
+	t := time.NewTimer(tw.timeout)
+	defer t.Stop()
+
+	select {
+	case err := <-tw.results:
+		return err
+
+	case <-t.C:
+		tw.degraded = time.Now()
+		fmt.Fprintf(os.Stderr, "warning: dest %s degraded: write did not complete within %v\n", tw.name, tw.timeout)
+		if tw.mode == TimeoutFail {
+			return ErrTimeout
+		}
+		return nil
+	}
+}
+
+// recover returns the writer to normal operation once the write that timed
+// out has completed with the given result.
+func (tw *TimeoutWriter) recover(err error) error {
+	msg := fmt.Sprintf("warning: dest %s recovered after %v", tw.name, time.Since(tw.degraded).Round(time.Millisecond))
+	if tw.dropped.any() {
+		msg += ": " + tw.dropped.String()
+	}
+	fmt.Fprintln(os.Stderr, msg)
+
+	// Without a marker, stderr is the only place the count is reported.
+	if tw.marker == nil {
+		tw.dropped.reset()
+	}
+	tw.degraded = time.Time{}
+
+	return err
+}
+
+// Flush flushes the underlying writer if it retains data between writes. If
+// the writer is degraded, it waits up to the timeout for its destination to
+// recover, then gives up on it.
+func (tw *TimeoutWriter) Flush() error {
+	if !tw.degraded.IsZero() {
+		t := time.NewTimer(tw.timeout)
+		defer t.Stop()
+
+		select {
+		case err := <-tw.results:
+			err = tw.recover(err)
+			if err != nil {
+				return err
+			}
+
+		case <-t.C:
+			fmt.Fprintf(os.Stderr, "warning: dest %s still degraded: abandoning pending write\n", tw.name)
+			return nil
+		}
+	}
+
+	return flush(tw.w)
+}
+
+// Close stops the writer's goroutine. A write that is still in progress
+// completes in the background, once the destination lets it.
+func (tw *TimeoutWriter) Close() error {
+	select {
+	case <-tw.closed:
+	default:
+		close(tw.closed)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/badvassal/rex/record"
+)
+
+// CondOp is the comparison a Cond performs.
+type CondOp int
+
+const (
+	CondEq    CondOp = iota // The field equals the value.
+	CondNe                  // The field is missing or differs from the value.
+	CondIn                  // The field equals one of the values.
+	CondNotIn               // The field is missing or equals none of the values.
+)
+
+// Cond is a condition on a field of a JSON object, such as `.level==error`.
+//
+// A value is given as text. It equals a string field with the same text, a
+// number field with the same numeric value, or a boolean or null field that it
+// spells. A quoted value, such as `"200"`, only equals a string.
+type Cond struct {
+	Path   []string // Keys leading to the field; an integer key indexes an array.
+	Op     CondOp
+	Values []CondValue
+}
+
+// CondValue is a value that a Cond compares fields to.
+type CondValue struct {
+	Text   string
+	Quoted bool // Only match strings.
+}
+
+// Match reports whether the condition holds for the given decoded object.
+func (c *Cond) Match(obj any) bool {
+	v, ok := lookup(obj, c.Path)
+
+	var found bool
+	if ok {
+		for _, cv := range c.Values {
+			if cv.equal(v) {
+				found = true
+				break
+			}
+		}
+	}
+
+	if c.Op == CondNe || c.Op == CondNotIn {
+		return !found
+	}
+	return found
+}
+
+// lookup returns the field of v at the given path.
+func lookup(v any, path []string) (any, bool) {
+	for _, key := range path {
+		switch t := v.(type) {
+		case map[string]any:
+			var ok bool
+			v, ok = t[key]
+			if !ok {
+				return nil, false
+			}
+
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// equal reports whether a field equals the value.
+func (cv CondValue) equal(v any) bool {
+	switch t := v.(type) {
+	case string:
+		return t == cv.Text
+
+	case json.Number:
+		if cv.Quoted {
+			return false
+		}
+		if t.String() == cv.Text {
+			return true
+		}
+		a, err1 := t.Float64()
+		b, err2 := strconv.ParseFloat(cv.Text, 64)
+		return err1 == nil && err2 == nil && a == b
+
+	case bool:
+		return !cv.Quoted && cv.Text == strconv.FormatBool(t)
+
+	case nil:
+		return !cv.Quoted && cv.Text == "null"
+
+	default:
+		// Objects and arrays equal no value.
+		return false
+	}
+}
+
+// WhereWriter implements record.Writer. It parses each record as a JSON object
+// and forwards it only if every condition holds for it. Records that are not
+// JSON objects are discarded.
+//
+// An inverted WhereWriter does the opposite of an unconditional one: it
+// forwards only the records that are not JSON objects.
+type WhereWriter struct {
+	w      record.Writer
+	conds  []*Cond
+	invert bool
+}
+
+// NewWhereWriter creates a WhereWriter that forwards records satisfying all of
+// conds.
+func NewWhereWriter(w record.Writer, conds []*Cond) *WhereWriter {
+	return &WhereWriter{
+		w:     w,
+		conds: conds,
+	}
+}
+
+// NewInvalidWriter creates a WhereWriter that forwards only the records that
+// are not JSON objects.
+func NewInvalidWriter(w record.Writer) *WhereWriter {
+	return &WhereWriter{
+		w:      w,
+		invert: true,
+	}
+}
+
+func (ww *WhereWriter) WriteRecord(rec *record.Record) error {
+	obj, ok := ParseJSONObject(rec.Data)
+	if ww.invert {
+		ok = !ok
+	} else if ok {
+		for _, c := range ww.conds {
+			if !c.Match(obj) {
+				ok = false
+				break
+			}
+		}
+	}
+
+	if !ok {
+		return nil
+	}
+	return ww.w.WriteRecord(rec)
+}
+
+// ParseJSONObject parses b as a single JSON object. Numbers are decoded as
+// json.Number, so that they keep their exact text.
+func ParseJSONObject(b []byte) (map[string]any, bool) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var obj map[string]any
+	err := dec.Decode(&obj)
+	if err != nil || obj == nil {
+		return nil, false
+	}
+
+	// Reject trailing data after the object.
+	_, err = dec.Token()
+	if err != io.EOF {
+		return nil, false
+	}
+
+	return obj, true
+}
+
+// Flush flushes the underlying writer if it retains data between writes.
+func (ww *WhereWriter) Flush() error {
+	return flush(ww.w)
+}
@@ -1,21 +1,40 @@
 package output
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"sync"
 	"syscall"
 
+	"github.com/badvassal/rex/record"
 	"golang.org/x/sys/unix"
 )
 
+// pipeBuf is the largest write to a pipe that the kernel guarantees to be
+// atomic (PIPE_BUF on Linux).
+const pipeBuf = 4096
+
 // BestEffortWriter implements io.Writer. It writes to a unix file descriptor,
 // treating EAGAIN and EWOULDBLOCK results as successes. That is, if the
 // destination file reaches capacity before the full write completes, this
 // function discards the unwritten data and reports success.
+//
+// An atomic BestEffortWriter treats each call to Write as a single record,
+// which it either writes whole or discards whole. It never writes a fragment
+// of a record.
+//
+// If the writer has a marker, it reports discarded data in-band: before
+// writing anything else, it writes a marker describing what was discarded.
+// Until the marker fits in the destination, subsequent writes are discarded
+// as well.
 type BestEffortWriter struct {
-	fd int
+	fd     int
+	atomic bool
+	marker MarkerFunc
+
+	dropped dropCount // Data discarded since the last marker was written.
 }
 
 func NewBestEffortWriter(fd int) *BestEffortWriter {
@@ -24,11 +43,30 @@ func NewBestEffortWriter(fd int) *BestEffortWriter {
 	}
 }
 
+func NewAtomicBestEffortWriter(fd int) *BestEffortWriter {
+	return &BestEffortWriter{
+		fd:     fd,
+		atomic: true,
+	}
+}
+
+// SetMarker configures the writer to report discarded data with markers built
+// by the given function.
+func (w *BestEffortWriter) SetMarker(m MarkerFunc) {
+	w.marker = m
+}
+
+// Close closes the writer's file descriptor.
+func (w *BestEffortWriter) Close() error {
+	return unix.Close(w.fd)
+}
+
 func (w *BestEffortWriter) writeOnce(p []byte) (int, error) {
 	n, err := unix.Write(w.fd, p)
 	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
 		// Zero bytes written due to full buffer. Treat these errors as
 		// successes.
+		w.drop(p)
 		return len(p), nil
 	}
 	if err != nil {
@@ -41,6 +79,20 @@ func (w *BestEffortWriter) writeOnce(p []byte) (int, error) {
 }
 
 func (w *BestEffortWriter) Write(b []byte) (int, error) {
+	// Don't let data follow a gap until the gap has been reported.
+	ok, err := w.writeMarker()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		w.drop(b)
+		return len(b), nil
+	}
+
+	if w.atomic {
+		return w.writeRecord(b)
+	}
+
 	var n int
 
 	for n < len(b) {
@@ -55,21 +107,134 @@ func (w *BestEffortWriter) Write(b []byte) (int, error) {
 	return n, nil
 }
 
-// AsyncWriter implements io.Writer. It performs nonblocking writes in a
+// drop records that the given data was discarded.
+func (w *BestEffortWriter) drop(b []byte) {
+	w.dropped.bytes += len(b)
+	if w.atomic {
+		w.dropped.records++
+	} else {
+		w.dropped.records += bytes.Count(b, []byte{'\n'})
+	}
+}
+
+// writeMarker writes a marker reporting the data discarded since the last
+// marker, if any. It returns false if there was not enough room for the
+// marker.
+func (w *BestEffortWriter) writeMarker() (bool, error) {
+	if w.marker == nil || !w.dropped.any() {
+		return true, nil
+	}
+
+	ok, err := w.writeWhole(w.dropped.marker(w.marker))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	w.dropped.reset()
+	return true, nil
+}
+
+// writeRecord writes b whole or not at all.
+func (w *BestEffortWriter) writeRecord(b []byte) (int, error) {
+	ok, err := w.writeWhole(b)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		w.drop(b)
+	}
+
+	return len(b), nil
+}
+
+// writeWhole writes b whole or not at all, returning false in the latter
+// case. A write of at most PIPE_BUF bytes to a pipe is atomic, so it suffices
+// to attempt it. A larger write is only attempted if the pipe has room for all
+// of it. In the unlikely event that such a write is partial anyway, the
+// remainder is written in blocking fashion.
+func (w *BestEffortWriter) writeWhole(b []byte) (bool, error) {
+	if len(b) > pipeBuf {
+		free, err := pipeFree(w.fd)
+		if err == nil && free < len(b) {
+			return false, nil
+		}
+	}
+
+	n, err := unix.Write(w.fd, b)
+	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if n < len(b) {
+		_, err := writeAll(w.fd, b[n:])
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// pipeFree returns the number of bytes that can be written to the given pipe
+// without blocking. It returns an error if fd does not refer to a pipe.
+func pipeFree(fd int) (int, error) {
+	size, err := unix.FcntlInt(uintptr(fd), syscall.F_GETPIPE_SZ, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// TIOCINQ is FIONREAD on Linux: the number of unread bytes in the pipe.
+	used, err := unix.IoctlGetInt(fd, unix.TIOCINQ)
+	if err != nil {
+		return 0, err
+	}
+
+	return size - used, nil
+}
+
+// writeAll writes all of b to a possibly nonblocking file descriptor, waiting
+// for it to become writable as necessary.
+func writeAll(fd int, b []byte) (int, error) {
+	var n int
+
+	for n < len(b) {
+		n2, err := unix.Write(fd, b[n:])
+		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+			_, err = unix.Poll(fds, -1)
+			if err != nil && err != syscall.EINTR {
+				return n, err
+			}
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n += n2
+	}
+
+	return n, nil
+}
+
+// AsyncWriter implements record.Writer. It performs nonblocking writes in a
 // dedicated goroutine. It is not possible to determine the results of a write
 // operation.
 type AsyncWriter struct {
 	sync.Mutex
-	w      io.Writer
-	inChan chan []byte
+	w      record.Writer
+	inChan chan *record.Record
 	wg     sync.WaitGroup
 	err    error
 }
 
-func NewAsyncWriter(ctx context.Context, w io.Writer) *AsyncWriter {
+func NewAsyncWriter(ctx context.Context, w record.Writer) *AsyncWriter {
 	aw := &AsyncWriter{
 		w:      w,
-		inChan: make(chan []byte),
+		inChan: make(chan *record.Record),
 	}
 
 	go func() {
@@ -80,8 +245,8 @@ func NewAsyncWriter(ctx context.Context, w io.Writer) *AsyncWriter {
 			case <-ctx.Done():
 				aw.stop(ctx.Err())
 
-			case b := <-aw.inChan:
-				err := aw.writeNow(b)
+			case rec := <-aw.inChan:
+				err := aw.writeNow(rec)
 				if err != nil {
 					aw.stop(err)
 				}
@@ -90,26 +255,26 @@ func NewAsyncWriter(ctx context.Context, w io.Writer) *AsyncWriter {
 
 		// The writer is done (in the stopped state). Complete all pending
 		// writes, then return.
-		for b := range aw.inChan {
-			aw.writeNow(b)
+		for rec := range aw.inChan {
+			aw.writeNow(rec)
 		}
 	}()
 
 	return aw
 }
 
-// Write schedules a write operation to run in the writer's goroutine. It
-// returns an error if the writer is not accepting new writes (i.e., in the
-// stopped state), otherwise it indicates success. The success return values
-// can be misleading, since the scheduled write has not actually completed yet.
-func (aw *AsyncWriter) Write(b []byte) (int, error) {
+// WriteRecord schedules a write operation to run in the writer's goroutine.
+// It returns an error if the writer is not accepting new writes (i.e., in the
+// stopped state), otherwise it indicates success. The success return value can
+// be misleading, since the scheduled write has not actually completed yet.
+func (aw *AsyncWriter) WriteRecord(rec *record.Record) error {
 	err := aw.acquire()
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	aw.inChan <- b
-	return len(b), nil
+	aw.inChan <- rec
+	return nil
 }
 
 // Err returns the error that put the writer in the stopped state, or nil if
@@ -126,6 +291,24 @@ func (aw *AsyncWriter) Wait() {
 	aw.wg.Wait()
 }
 
+// Flush waits for all scheduled writes to complete, then flushes the
+// underlying writer if it retains data between writes. The flush runs in the
+// caller's goroutine.
+func (aw *AsyncWriter) Flush() error {
+	aw.Wait()
+
+	err := aw.Err()
+	if err != nil {
+		return err
+	}
+
+	f, ok := aw.w.(record.Flusher)
+	if !ok {
+		return nil
+	}
+	return f.Flush()
+}
+
 // acquire records the presence of a pending write operation. It must be called
 // before attempting to schedule a write. It returns an error if the writer has
 // been stopped.
@@ -177,44 +360,99 @@ func (aw *AsyncWriter) stop(err error) bool {
 	return true
 }
 
-// writeNow writes the given bytes in the current goroutine.
-func (aw *AsyncWriter) writeNow(b []byte) error {
-	defer aw.release() // Acquired by Write() call in parent goroutine.
-	_, err := aw.w.Write(b)
-	return err
+// writeNow writes the given record in the current goroutine.
+func (aw *AsyncWriter) writeNow(rec *record.Record) error {
+	defer aw.release() // Acquired by WriteRecord() call in parent goroutine.
+	return aw.w.WriteRecord(rec)
 }
 
-// SyncWriter implements io.Writer. It duplicates output to multiple writers in
-// parallel.
+// SyncWriter implements record.Writer. It duplicates output to multiple
+// writers in parallel.
 type SyncWriter struct {
-	aws []*AsyncWriter
+	aws  []*AsyncWriter
+	acks *ackList
 }
 
-func NewSyncWriter(ctx context.Context, ws []io.Writer) *SyncWriter {
+func NewSyncWriter(ctx context.Context, ws []record.Writer) *SyncWriter {
 	var aws []*AsyncWriter
 	for _, w := range ws {
 		aws = append(aws, NewAsyncWriter(ctx, w))
 	}
 
 	return &SyncWriter{
-		aws: aws,
+		aws:  aws,
+		acks: &ackList{},
 	}
 }
 
-// Write writes the given bytes to each of the sync writer's constituent
-// writers in parallel, then waits for all the writes to complete.
-func (sw *SyncWriter) Write(b []byte) (int, error) {
+// WriteRecord writes the given record to each of the sync writer's
+// constituent writers in parallel, then waits for all the writes to complete.
+func (sw *SyncWriter) WriteRecord(rec *record.Record) error {
 	for _, aw := range sw.aws {
-		n, err := aw.Write(b)
+		err := aw.WriteRecord(rec)
 		if err != nil {
-			return n, err
+			return err
 		}
 	}
 
 	// Wait for writes to complete.
 	sw.wait()
 
-	return len(b), nil
+	return nil
+}
+
+// Flush flushes each of the sync writer's constituent writers.
+func (sw *SyncWriter) Flush() error {
+	for _, aw := range sw.aws {
+		err := aw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Save saves the queues of the constituent writers for a later run, where
+// they support it. The writers must not be in the middle of a write.
+func (sw *SyncWriter) Save() error {
+	var errs []error
+	for _, aw := range sw.aws {
+		errs = append(errs, save(aw.w))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Select returns a sync writer that writes only to the receiver's constituent
+// writers whose indices satisfy the given predicate. The returned writer
+// shares its constituent writers with the receiver, so the two must not be
+// written to concurrently.
+func (sw *SyncWriter) Select(keep func(i int) bool) *SyncWriter {
+	var aws []*AsyncWriter
+	for i, aw := range sw.aws {
+		if keep(i) {
+			aws = append(aws, aw)
+		}
+	}
+
+	return &SyncWriter{
+		aws:  aws,
+		acks: &ackList{},
+	}
+}
+
+// Track arranges for f to be called once the records written so far have left
+// every constituent writer, such as by leaving their queues. Callbacks are
+// called one at a time, in the order they were registered. A callback is
+// skipped if a writer failed before its records left it.
+func (sw *SyncWriter) Track(f func()) {
+	var ws []record.Writer
+	for _, aw := range sw.aws {
+		ws = append(ws, aw.w)
+	}
+
+	sw.acks.add(ws, f)
 }
 
 // wait blocks until all scheduled writes have completed.
@@ -223,3 +461,60 @@ func (sw *SyncWriter) wait() {
 		aw.Wait()
 	}
 }
+
+// ackList calls the callbacks registered with SyncWriter.Track in order, each
+// once the records it waits for have left their writers.
+type ackList struct {
+	sync.Mutex
+	pending []*ack
+}
+
+// ack is a callback waiting in an ackList.
+type ack struct {
+	f     func()
+	ready bool // The records have left their writers, or a writer failed.
+	ok    bool // The records left every writer.
+}
+
+// add registers a callback that waits for the records written so far to
+// leave the given writers.
+func (al *ackList) add(ws []record.Writer, f func()) {
+	a := &ack{f: f}
+
+	al.Lock()
+	al.pending = append(al.pending, a)
+	al.Unlock()
+
+	trackAll(ws, func(ok bool) {
+		al.Lock()
+		defer al.Unlock()
+
+		a.ready = true
+		a.ok = ok
+
+		for len(al.pending) > 0 && al.pending[0].ready {
+			first := al.pending[0]
+			al.pending[0] = nil
+			al.pending = al.pending[1:]
+
+			if first.ok {
+				first.f()
+			}
+		}
+	})
+}
+
+// trackAll arranges for done to be called once the records written so far
+// have left every one of the given writers. It reports false if any of them
+// failed first.
+func trackAll(ws []record.Writer, done func(ok bool)) {
+	if len(ws) == 0 {
+		done(true)
+		return
+	}
+
+	done = record.TrackAll(len(ws), done)
+	for _, w := range ws {
+		record.Track(w, done)
+	}
+}
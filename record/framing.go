@@ -0,0 +1,408 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FramingKind is the way a Framing marks the boundaries of records.
+type FramingKind int
+
+const (
+	FramingDelim  FramingKind = iota // Each record is terminated by a delimiter.
+	FramingU32BE                     // Each record is preceded by its length, as a big-endian uint32.
+	FramingVarint                    // Each record is preceded by its length, as an unsigned varint.
+	FramingFixed                     // Each record has the same size.
+)
+
+// Framing specifies how a stream of bytes is divided into records.
+type Framing struct {
+	Kind  FramingKind
+	Delim []byte // Record terminator, for FramingDelim.
+	Size  int    // Record size, for FramingFixed.
+}
+
+// LineFraming returns a Framing that divides a stream into lines.
+func LineFraming() *Framing {
+	return &Framing{
+		Kind:  FramingDelim,
+		Delim: []byte{'\n'},
+	}
+}
+
+// ParseFraming parses a framing specification: `lines`, `nul`,
+// `delim:<bytes>`, `u32be-length`, `varint-length`, or `fixed:<n>`. The bytes
+// of a delimiter may be written as Go escape sequences, such as `\r\n` or
+// `\x00`.
+func ParseFraming(s string) (*Framing, error) {
+	switch s {
+	case "lines":
+		return LineFraming(), nil
+	case "nul":
+		return &Framing{Kind: FramingDelim, Delim: []byte{0}}, nil
+	case "u32be-length":
+		return &Framing{Kind: FramingU32BE}, nil
+	case "varint-length":
+		return &Framing{Kind: FramingVarint}, nil
+	}
+
+	if d, ok := strings.CutPrefix(s, "delim:"); ok {
+		delim, err := unescape(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delimiter: %w", err)
+		}
+		if len(delim) == 0 {
+			return nil, fmt.Errorf("empty delimiter")
+		}
+		return &Framing{Kind: FramingDelim, Delim: delim}, nil
+	}
+
+	if n, ok := strings.CutPrefix(s, "fixed:"); ok {
+		size, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size: %w", err)
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("size must be positive: have=%d", size)
+		}
+		return &Framing{Kind: FramingFixed, Size: size}, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized framing: have=%s want=lines|nul|delim:<bytes>|u32be-length|varint-length|fixed:<n>", s)
+}
+
+// unescape decodes the Go escape sequences in s.
+func unescape(s string) ([]byte, error) {
+	var b []byte
+	for s != "" {
+		c, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			return nil, err
+		}
+		if c < 0x100 && !multibyte {
+			b = append(b, byte(c))
+		} else {
+			b = append(b, string(c)...)
+		}
+		s = tail
+	}
+	return b, nil
+}
+
+// String returns the framing's specification, as ParseFraming accepts it.
+func (f *Framing) String() string {
+	switch f.Kind {
+	case FramingDelim:
+		switch string(f.Delim) {
+		case "\n":
+			return "lines"
+		case "\x00":
+			return "nul"
+		}
+		q := strconv.Quote(string(f.Delim))
+		return "delim:" + q[1:len(q)-1]
+	case FramingU32BE:
+		return "u32be-length"
+	case FramingVarint:
+		return "varint-length"
+	case FramingFixed:
+		return fmt.Sprintf("fixed:%d", f.Size)
+	default:
+		return fmt.Sprintf("FramingKind(%d)", f.Kind)
+	}
+}
+
+// Delimited reports whether records are terminated by a delimiter, so that
+// they can hold text that is rewritten without reframing.
+func (f *Framing) Delimited() bool {
+	return f.Kind == FramingDelim
+}
+
+// LengthPrefix returns the function that encodes the length prefixes of this
+// framing, or nil if records are not preceded by their lengths.
+func (f *Framing) LengthPrefix() LengthPrefix {
+	switch f.Kind {
+	case FramingU32BE:
+		return U32BEPrefix
+	case FramingVarint:
+		return VarintPrefix
+	default:
+		return nil
+	}
+}
+
+// NewFramer creates a Framer that divides a stream into records with this
+// framing. Its records are attributed to the named source.
+//
+// A record longer than maxLen is emitted in pieces, so that a stream without
+// delimiters, or with a corrupt length, cannot exhaust memory. The pieces of a
+// length-prefixed record are unframed: together they hold the record's bytes,
+// prefix included, exactly as they appeared in the stream.
+func (f *Framing) NewFramer(source string, maxLen int) Framer {
+	switch f.Kind {
+	case FramingDelim:
+		return &delimFramer{
+			frameBuffer: frameBuffer{source: source},
+			delim:       f.Delim,
+			maxLen:      maxLen,
+		}
+
+	case FramingU32BE, FramingVarint:
+		return &lengthFramer{
+			frameBuffer: frameBuffer{source: source},
+			varint:      f.Kind == FramingVarint,
+			prefix:      f.LengthPrefix(),
+			maxLen:      maxLen,
+		}
+
+	case FramingFixed:
+		return &fixedFramer{
+			frameBuffer: frameBuffer{source: source},
+			size:        f.Size,
+		}
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid framing: %v", f.Kind))
+	}
+}
+
+// Framer divides a stream of bytes into records. Data that does not yet form
+// a complete record is retained until the record is finished by a subsequent
+// call.
+type Framer interface {
+	// Split consumes the given bytes, which were read at time t, and
+	// returns the records they complete. A record is timestamped with the
+	// time its first byte was read. Split does not retain b.
+	Split(b []byte, t time.Time) []*Record
+
+	// Flush returns the incomplete record retained by the framer, or nil if
+	// there is none. It is called when the stream ends.
+	Flush() *Record
+
+	// Empty reports whether the framer retains nothing.
+	Empty() bool
+}
+
+// frameBuffer holds the data a Framer has not yet turned into records.
+type frameBuffer struct {
+	source  string
+	pending []byte
+	off     int       // Start of the data not yet consumed.
+	started time.Time // When the unconsumed data started to arrive.
+}
+
+// add appends data read at time t to the buffer, first discarding the data
+// already consumed.
+func (fb *frameBuffer) add(b []byte, t time.Time) {
+	fb.pending = append(fb.pending[:0], fb.pending[fb.off:]...)
+	fb.off = 0
+
+	if len(fb.pending) == 0 {
+		fb.started = t
+	}
+	fb.pending = append(fb.pending, b...)
+}
+
+// unread returns the data not yet consumed.
+func (fb *frameBuffer) unread() []byte {
+	return fb.pending[fb.off:]
+}
+
+// record consumes n bytes and returns a record holding a copy of them. The
+// data that remains is considered to have started arriving at time t.
+func (fb *frameBuffer) record(n int, t time.Time) *Record {
+	rec := &Record{
+		Data:   append([]byte(nil), fb.pending[fb.off:fb.off+n]...),
+		Source: fb.source,
+		Time:   fb.started,
+	}
+	fb.off += n
+	fb.started = t
+	return rec
+}
+
+// Empty reports whether all the data has been consumed.
+func (fb *frameBuffer) Empty() bool {
+	return len(fb.unread()) == 0
+}
+
+// flush consumes the remaining data and returns it as an unterminated record,
+// or nil if there is none.
+func (fb *frameBuffer) flush() *Record {
+	n := len(fb.unread())
+	if n == 0 {
+		return nil
+	}
+	return fb.record(n, fb.started)
+}
+
+// delimFramer is a Framer for delimited records, such as lines.
+type delimFramer struct {
+	frameBuffer
+	delim  []byte
+	maxLen int
+}
+
+func (f *delimFramer) Split(b []byte, t time.Time) []*Record {
+	var recs []*Record
+
+	// Only search the new data, plus any part of a delimiter that the
+	// pending data ends with.
+	from := max(0, len(f.unread())-len(f.delim)+1)
+	f.add(b, t)
+
+	for {
+		i := bytes.Index(f.unread()[from:], f.delim)
+		if i < 0 {
+			break
+		}
+
+		rec := f.record(from+i, t)
+		rec.Delim = f.delim
+		rec.Framed = true
+		f.off += len(f.delim)
+		recs = append(recs, rec)
+		from = 0
+	}
+
+	// Don't let an overlong record accumulate without bound.
+	for f.maxLen > 0 && len(f.unread()) >= f.maxLen {
+		recs = append(recs, f.record(f.maxLen, t))
+	}
+
+	return recs
+}
+
+func (f *delimFramer) Flush() *Record {
+	return f.flush()
+}
+
+// maxVarintLen is the longest record length a varint prefix may hold before
+// the prefix is considered corrupt.
+const maxVarintLen = 1 << 40
+
+// lengthFramer is a Framer for records preceded by their lengths.
+type lengthFramer struct {
+	frameBuffer
+	varint bool
+	prefix LengthPrefix
+	maxLen int
+
+	// Bytes still to pass through unframed, of a record too long to hold.
+	passthrough int
+}
+
+func (f *lengthFramer) Split(b []byte, t time.Time) []*Record {
+	var recs []*Record
+
+	f.add(b, t)
+	for len(f.unread()) > 0 {
+		if f.passthrough > 0 {
+			n := min(f.passthrough, len(f.unread()))
+			recs = append(recs, f.record(n, t))
+			f.passthrough -= n
+			continue
+		}
+
+		hdrLen, n, ok := f.header()
+		if !ok {
+			break
+		}
+
+		// Pass a record too long to hold, or a corrupt length, through
+		// in pieces.
+		if n < 0 {
+			f.passthrough = len(f.unread())
+			continue
+		}
+		if hdrLen+n > f.maxLen {
+			f.passthrough = hdrLen + n
+			continue
+		}
+
+		if len(f.unread()) < hdrLen+n {
+			break
+		}
+
+		f.off += hdrLen
+		rec := f.record(n, t)
+		rec.Prefix = f.prefix
+		rec.Framed = true
+		recs = append(recs, rec)
+	}
+
+	return recs
+}
+
+// header parses the length prefix at the start of the unread data. It returns
+// the length of the prefix and of the record that follows it, or a negative
+// record length if the prefix is corrupt. It returns false if the prefix is
+// incomplete.
+func (f *lengthFramer) header() (int, int, bool) {
+	b := f.unread()
+	if !f.varint {
+		if len(b) < 4 {
+			return 0, 0, false
+		}
+		return 4, int(binary.BigEndian.Uint32(b)), true
+	}
+
+	n, hdrLen := binary.Uvarint(b)
+	switch {
+	case hdrLen == 0:
+		return 0, 0, false
+	case hdrLen < 0 || n > maxVarintLen:
+		return max(hdrLen, -hdrLen), -1, true
+	default:
+		return hdrLen, int(n), true
+	}
+}
+
+func (f *lengthFramer) Empty() bool {
+	return f.passthrough == 0 && f.frameBuffer.Empty()
+}
+
+func (f *lengthFramer) Flush() *Record {
+	f.passthrough = 0
+	return f.flush()
+}
+
+// fixedFramer is a Framer for records of a fixed size.
+type fixedFramer struct {
+	frameBuffer
+	size int
+}
+
+func (f *fixedFramer) Split(b []byte, t time.Time) []*Record {
+	var recs []*Record
+
+	f.add(b, t)
+	for len(f.unread()) >= f.size {
+		rec := f.record(f.size, t)
+		rec.Framed = true
+		recs = append(recs, rec)
+	}
+
+	return recs
+}
+
+func (f *fixedFramer) Flush() *Record {
+	return f.flush()
+}
+
+// LengthPrefix appends the length prefix of an n-byte record to b.
+type LengthPrefix func(b []byte, n int) []byte
+
+// U32BEPrefix is a LengthPrefix that encodes lengths as big-endian uint32s.
+func U32BEPrefix(b []byte, n int) []byte {
+	return binary.BigEndian.AppendUint32(b, uint32(n))
+}
+
+// VarintPrefix is a LengthPrefix that encodes lengths as unsigned varints.
+func VarintPrefix(b []byte, n int) []byte {
+	return binary.AppendUvarint(b, uint64(n))
+}
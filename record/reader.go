@@ -0,0 +1,103 @@
+package record
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// sessions numbers the sessions of all readers.
+var sessions atomic.Uint64
+
+// Reader reads records from an underlying stream. If the reader has a
+// framing, each record is a single frame, such as a line. Otherwise, each
+// record is whatever a single read of the underlying stream returns. Each
+// reader is a session of its own, so that its records are never joined with
+// those of another stream of the same source.
+type Reader struct {
+	r       io.Reader
+	source  string
+	session uint64
+	buf     []byte
+	framing *Framing  // nil if the reader has no framing.
+	framer  Framer    // nil if the reader has no framing.
+	recs    []*Record // Records split off but not yet returned.
+	err     error     // Sticky error from the underlying stream.
+}
+
+// NewReader creates a reader that reads from r using a buffer of bufSize
+// bytes. Its records are attributed to the named source. framing may be nil.
+func NewReader(r io.Reader, source string, bufSize int, framing *Framing) *Reader {
+	rr := &Reader{
+		r:       r,
+		source:  source,
+		session: sessions.Add(1),
+		buf:     make([]byte, bufSize),
+		framing: framing,
+	}
+
+	if framing != nil {
+		rr.framer = framing.NewFramer(source, bufSize)
+	}
+
+	return rr
+}
+
+// Read returns the next record. At the end of the stream, it returns io.EOF.
+func (rr *Reader) Read() (*Record, error) {
+	for len(rr.recs) == 0 {
+		if rr.err != nil {
+			return nil, rr.err
+		}
+		rr.fill()
+	}
+
+	rec := rr.recs[0]
+	rr.recs = rr.recs[1:]
+	rec.Session = rr.session
+	return rec, nil
+}
+
+// fill performs a single read of the underlying stream and queues the
+// resulting records.
+func (rr *Reader) fill() {
+	n, err := rr.r.Read(rr.buf)
+	now := time.Now()
+
+	if n > 0 {
+		if rr.framer != nil {
+			rr.recs = append(rr.recs, rr.framer.Split(rr.buf[:n], now)...)
+		} else {
+			rr.recs = append(rr.recs, &Record{
+				Data:   append([]byte(nil), rr.buf[:n]...),
+				Source: rr.source,
+				Time:   now,
+			})
+		}
+	}
+
+	if err != nil {
+		// Don't lose a final record that lacks its delimiter. Terminate
+		// it, so that whatever follows it in an output, such as the data
+		// of another connection, is not joined onto it. A truncated
+		// length-prefixed or fixed-size record can't be terminated; it is
+		// only marked.
+		if rr.framer != nil {
+			if rec := rr.framer.Flush(); rec != nil {
+				rec.Unterminated = true
+				if rr.framing.Delimited() {
+					rec.Delim = rr.framing.Delim
+					rec.Framed = true
+				}
+				rr.recs = append(rr.recs, rec)
+			}
+		}
+
+		if !errors.Is(err, io.EOF) {
+			err = fmt.Errorf("read %s: %w", rr.source, err)
+		}
+		rr.err = err
+	}
+}
@@ -0,0 +1,72 @@
+package record
+
+import (
+	"time"
+)
+
+// Record is a unit of data read from an input. Depending on how its input is
+// framed, a record is either a complete frame, such as a line, or an
+// arbitrary chunk.
+type Record struct {
+	Data   []byte       // Record contents, excluding the delimiter or length prefix.
+	Delim  []byte       // Delimiter that terminated the record; nil if none.
+	Prefix LengthPrefix // Encodes the length prefix that framed the record; nil if none.
+	Framed bool         // The record is a whole frame, such as a line or a fixed-size record.
+	Source string       // Name of the input the record was read from.
+	Time   time.Time    // When rex read the record; zero if unknown.
+
+	// Session distinguishes the streams that make up an input, such as the
+	// connections to a listening socket. Records from different sessions
+	// are never joined together.
+	Session uint64
+
+	// Unterminated reports that the input ended before the record's
+	// delimiter, so rex supplied Delim.
+	Unterminated bool
+
+	// Ack, if not nil, is called once the record has been written to every
+	// destination that accepts it.
+	Ack func()
+}
+
+// Stream identifies the stream a record was read from.
+type Stream struct {
+	Source  string
+	Session uint64
+}
+
+// Stream returns the stream the record was read from.
+func (r *Record) Stream() Stream {
+	return Stream{
+		Source:  r.Source,
+		Session: r.Session,
+	}
+}
+
+// Bytes returns the record as it appeared in its input: its contents framed
+// by its length prefix or delimiter.
+func (r *Record) Bytes() []byte {
+	if len(r.Delim) == 0 && r.Prefix == nil {
+		return r.Data
+	}
+
+	return r.AppendTo(make([]byte, 0, r.Size()))
+}
+
+// AppendTo appends the record, as Bytes returns it, to b.
+func (r *Record) AppendTo(b []byte) []byte {
+	if r.Prefix != nil {
+		b = r.Prefix(b, len(r.Data))
+	}
+	b = append(b, r.Data...)
+	return append(b, r.Delim...)
+}
+
+// Size returns the length of the record as Bytes returns it.
+func (r *Record) Size() int {
+	n := len(r.Data) + len(r.Delim)
+	if r.Prefix != nil {
+		n += len(r.Prefix(nil, len(r.Data)))
+	}
+	return n
+}
@@ -0,0 +1,251 @@
+package record
+
+import (
+	"io"
+	"sync"
+)
+
+// Writer consumes records. A Writer must not modify the records it is given,
+// since the same record is written to several destinations at once.
+type Writer interface {
+	WriteRecord(rec *Record) error
+}
+
+// Flusher is implemented by Writers that retain data between writes. Flush
+// writes out whatever the writer retains. It is called when the input ends.
+type Flusher interface {
+	Flush() error
+}
+
+// Tracker is implemented by Writers that may still hold records after
+// WriteRecord returns, such as queues.
+type Tracker interface {
+	// Track arranges for done to be called once every record written so
+	// far has left the writer, whether it was written out or discarded by
+	// design. If the writer fails first, done is called with false.
+	Track(done func(ok bool))
+}
+
+// Track arranges for done to be called once every record written to w so far
+// has left it. If w does not hold records, done is called right away.
+func Track(w Writer, done func(ok bool)) {
+	if t, ok := w.(Tracker); ok {
+		t.Track(done)
+		return
+	}
+	done(true)
+}
+
+// TrackAll returns a callback that calls done once it has itself been called
+// n times, reporting false if any of those calls did.
+func TrackAll(n int, done func(ok bool)) func(ok bool) {
+	var mu sync.Mutex
+	all := true
+
+	return func(ok bool) {
+		mu.Lock()
+		n--
+		all = all && ok
+		last := n == 0
+		mu.Unlock()
+
+		if last {
+			done(all)
+		}
+	}
+}
+
+// streamWriter implements Writer. It writes each record, followed by its
+// delimiter, to an io.Writer in a single call.
+type streamWriter struct {
+	w io.Writer
+}
+
+// NewStreamWriter creates a Writer that writes records to the given
+// io.Writer.
+func NewStreamWriter(w io.Writer) Writer {
+	return &streamWriter{
+		w: w,
+	}
+}
+
+func (sw *streamWriter) WriteRecord(rec *Record) error {
+	_, err := sw.w.Write(rec.Bytes())
+	return err
+}
+
+// FrameWriter implements Writer. It writes records framed as its Framing
+// specifies, such as lines. A record that its input framed is re-encoded with
+// the writer's delimiter or length prefix. Other data is divided into frames
+// first; an incomplete frame is retained until a later record from the same
+// stream completes it, or until the stream ends.
+//
+// The writer is a Tracker: data retained in an incomplete frame has not left
+// it until the frame is written.
+type FrameWriter struct {
+	w       Writer
+	framing *Framing
+	split   *Framing // How unframed data is divided into records.
+	maxLen  int
+	framers map[Stream]Framer
+
+	// Callbacks waiting for the incomplete frame of a stream to be written.
+	waiting map[Stream][]func(ok bool)
+}
+
+// NewFrameWriter creates a FrameWriter that writes to w. Frames longer than
+// maxLen are passed on in pieces.
+func NewFrameWriter(w Writer, framing *Framing, maxLen int) *FrameWriter {
+	// Unframed data holds no length prefixes of its own, so it is divided
+	// into lines, which are then prefixed with their lengths.
+	split := framing
+	if framing.LengthPrefix() != nil {
+		split = LineFraming()
+	}
+
+	return &FrameWriter{
+		w:       w,
+		framing: framing,
+		split:   split,
+		maxLen:  maxLen,
+		framers: map[Stream]Framer{},
+		waiting: map[Stream][]func(ok bool){},
+	}
+}
+
+// encode frames rec with the writer's framing, in place. A piece of a record
+// too long to hold is left unframed.
+func (fw *FrameWriter) encode(rec *Record) {
+	if !rec.Framed {
+		return
+	}
+
+	rec.Delim = nil
+	rec.Prefix = fw.framing.LengthPrefix()
+	if fw.framing.Delimited() {
+		rec.Delim = fw.framing.Delim
+	}
+}
+
+func (fw *FrameWriter) WriteRecord(rec *Record) error {
+	// Fixed-size frames have no delimiter or prefix to encode: the contents
+	// of framed records are divided into frames like any other data.
+	if rec.Framed && fw.framing.Kind != FramingFixed {
+		r := *rec
+		fw.encode(&r)
+		return fw.w.WriteRecord(&r)
+	}
+
+	b := rec.Bytes()
+	if rec.Framed {
+		b = rec.Data
+	}
+
+	stream := rec.Stream()
+	f := fw.framers[stream]
+	if f == nil {
+		f = fw.split.NewFramer(rec.Source, fw.maxLen)
+		fw.framers[stream] = f
+	}
+
+	recs := f.Split(b, rec.Time)
+
+	// An unterminated record is the last of its stream.
+	if rec.Unterminated {
+		if r := fw.flush(f); r != nil {
+			r.Unterminated = true
+			recs = append(recs, r)
+		}
+	}
+	if f.Empty() {
+		delete(fw.framers, stream)
+	}
+
+	for _, r := range recs {
+		r.Session = rec.Session
+		fw.encode(r)
+		err := fw.w.WriteRecord(r)
+		if err != nil {
+			fw.release(stream, err)
+			return err
+		}
+	}
+
+	// The first record holds the data retained before this one, if any.
+	if len(recs) > 0 {
+		fw.release(stream, nil)
+	}
+
+	return nil
+}
+
+// Track arranges for done to be called once the records written so far have
+// left the writer: once the incomplete frames it retains have been written,
+// and the records written have left the underlying writer.
+func (fw *FrameWriter) Track(done func(ok bool)) {
+	var held []Stream
+	for stream, f := range fw.framers {
+		if !f.Empty() {
+			held = append(held, stream)
+		}
+	}
+
+	if len(held) == 0 {
+		Track(fw.w, done)
+		return
+	}
+
+	done = TrackAll(len(held), done)
+	for _, stream := range held {
+		fw.waiting[stream] = append(fw.waiting[stream], done)
+	}
+}
+
+// release calls the callbacks waiting for the incomplete frame of the given
+// stream once it has been written, tracking it through the underlying
+// writer. If writing it failed, they are called with false.
+func (fw *FrameWriter) release(stream Stream, err error) {
+	for _, done := range fw.waiting[stream] {
+		if err != nil {
+			done(false)
+			continue
+		}
+		Track(fw.w, done)
+	}
+	delete(fw.waiting, stream)
+}
+
+// flush returns the incomplete frame f retains, or nil if there is none. The
+// frame is given a length prefix if the writer's framing has one, since a
+// length-prefixed stream can't hold data outside its records.
+func (fw *FrameWriter) flush(f Framer) *Record {
+	rec := f.Flush()
+	if rec != nil {
+		rec.Prefix = fw.framing.LengthPrefix()
+		rec.Framed = rec.Prefix != nil
+	}
+	return rec
+}
+
+// Flush writes the incomplete frames retained for every stream.
+func (fw *FrameWriter) Flush() error {
+	for stream, f := range fw.framers {
+		rec := fw.flush(f)
+		if rec == nil {
+			fw.release(stream, nil)
+			continue
+		}
+		rec.Session = stream.Session
+
+		err := fw.w.WriteRecord(rec)
+		fw.release(stream, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f, ok := fw.w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
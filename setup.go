@@ -3,24 +3,120 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
+	"strings"
 
 	"github.com/badvassal/rex/dest"
+	"github.com/badvassal/rex/output"
+	"github.com/badvassal/rex/record"
+	"github.com/badvassal/rex/source"
 )
 
 type Env struct {
 	ReadBufSize int
-	Writers     []io.Writer
+	Dests       []*dest.Dest
+	Writers     []record.Writer
+	Inputs      []source.Input
+	Exec        []string // Command to run in exec mode; nil otherwise.
+}
+
+// specList implements flag.Value. It collects the values of a flag that may be
+// specified more than once.
+type specList []string
+
+func (l *specList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *specList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Destinations that pass a child process's output through to the terminal in
+// exec mode.
+var execPassthrough = []string{
+	"type=fd,id=1,stream=stdout",
+	"type=fd,id=2,stream=stderr",
+}
+
+// splitExecArgs splits the arguments following `exec` into dest specifiers
+// and the command to run. The two are separated by a `--` argument.
+func splitExecArgs(args []string) ([]string, []string, error) {
+	for i, arg := range args {
+		if arg == "--" {
+			if i == len(args)-1 {
+				return nil, nil, fmt.Errorf("exec: missing command after --")
+			}
+			return args[:i], args[i+1:], nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("exec: missing -- before command")
 }
 
 func parseArgs() (*Env, error) {
+	var srcArgs specList
+	var queueSize int
+	var multiline *output.Multiline
 	readBufSize := flag.Int("b", 64*1024, "read buffer size")
+	flag.Var(&srcArgs, "i", "input specifier; may be repeated (default stdin)")
+	flag.Func("q", "size of each output's queue, e.g. 4MB (default 0: write to all outputs in lockstep)", func(s string) error {
+		var err error
+		queueSize, err = dest.ParseSize(s)
+		return err
+	})
+	for _, name := range []string{"start", "continue", "maxlines", "timeout"} {
+		name := name
+		flag.Func("multiline."+name, "default multiline."+name+" for every output", func(s string) error {
+			if multiline == nil {
+				multiline = &output.Multiline{}
+			}
+			return dest.ParseMultiline(multiline, name, s)
+		})
+	}
 	flag.Parse()
 
-	// All remaining arguments specify destinations. Parse each and append
-	// their corresponding writers to ws.
-	var ws []io.Writer
-	for _, arg := range flag.Args() {
+	if multiline != nil {
+		err := dest.CheckMultiline(multiline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// All remaining arguments specify destinations, unless rex is running in
+	// exec mode. In exec mode, destinations precede a `--` argument and the
+	// command to run follows it.
+	destArgs := flag.Args()
+	var execArgs []string
+	if len(destArgs) > 0 && destArgs[0] == "exec" {
+		var err error
+		destArgs, execArgs, err = splitExecArgs(destArgs[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		destArgs = append(append([]string{}, execPassthrough...), destArgs...)
+	}
+
+	srcs, err := parseSources(srcArgs, execArgs != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the names of all input streams. In exec mode, the child's
+	// stdout and stderr are inputs too.
+	var inputs []string
+	for _, s := range srcs {
+		inputs = append(inputs, s.Name)
+	}
+	if execArgs != nil {
+		inputs = append(inputs, execStreams...)
+	}
+
+	// Parse each destination, grouping the members of each failover group.
+	var all, outputs []*dest.Dest
+	groups := map[string][]*dest.Dest{}
+	for _, arg := range destArgs {
 		fail := func(err error) (*Env, error) {
 			return nil, fmt.Errorf(`failed to process argument "%s": %w`, arg, err)
 		}
@@ -30,11 +126,55 @@ func parseArgs() (*Env, error) {
 			return fail(err)
 		}
 
-		w, err := d.Open()
+		if d.QueueSize == 0 {
+			d.QueueSize = queueSize
+		}
+		if multiline != nil {
+			err := d.DefaultMultiline(multiline)
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+		if !acceptsAny(d, inputs) {
+			return fail(fmt.Errorf("stream matches no input: have=%s want=one of %v", d.Stream, inputs))
+		}
+
+		all = append(all, d)
+		if d.Group == "" {
+			outputs = append(outputs, d)
+		} else {
+			// A group takes the place of its first member.
+			if groups[d.Group] == nil {
+				outputs = append(outputs, d)
+			}
+			groups[d.Group] = append(groups[d.Group], d)
+		}
+	}
+
+	err = dest.ResolveInvalid(all)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build a writer for each destination or group. A group is represented
+	// by its first member: the members of a group agree on which streams
+	// they accept.
+	var ds []*dest.Dest
+	var ws []record.Writer
+	for _, d := range outputs {
+		var w record.Writer
+		var err error
+		if d.Group == "" {
+			w, err = d.NewWriter()
+		} else {
+			w, err = dest.NewGroupWriter(groups[d.Group])
+		}
 		if err != nil {
-			return fail(err)
+			return nil, fmt.Errorf(`failed to process output "%s": %w`, d.Name(), err)
 		}
 
+		ds = append(ds, d)
 		ws = append(ws, w)
 	}
 
@@ -42,8 +182,61 @@ func parseArgs() (*Env, error) {
 		return nil, fmt.Errorf("at least one output required")
 	}
 
+	// When rex merges several inputs, frame each, by lines unless it has a
+	// framing of its own, so that records from different inputs are never
+	// spliced together.
+	merge := len(inputs) > 1
+
+	var ins []source.Input
+	for _, s := range srcs {
+		if s.Framing == nil && merge {
+			s.Framing = record.LineFraming()
+		}
+
+		in, err := s.Open(*readBufSize)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to open input "%s": %w`, s.Name, err)
+		}
+
+		ins = append(ins, in)
+	}
+
 	return &Env{
 		ReadBufSize: *readBufSize,
+		Dests:       ds,
 		Writers:     ws,
+		Inputs:      ins,
+		Exec:        execArgs,
 	}, nil
 }
+
+// parseSources parses the given source specifiers. If there are none, rex
+// reads its stdin, unless it is running in exec mode.
+func parseSources(args []string, exec bool) ([]*source.Source, error) {
+	if len(args) == 0 && !exec {
+		return []*source.Source{source.Stdin()}, nil
+	}
+
+	var srcs []*source.Source
+	for _, arg := range args {
+		s, err := source.Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to process input "%s": %w`, arg, err)
+		}
+
+		srcs = append(srcs, s)
+	}
+
+	return srcs, nil
+}
+
+// acceptsAny reports whether the given dest receives data from at least one
+// of the named input streams.
+func acceptsAny(d *dest.Dest, inputs []string) bool {
+	for _, name := range inputs {
+		if d.Accepts(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/badvassal/rex/record"
+)
+
+// followPollInterval is how often a followed file is checked for new data
+// after reaching its end.
+const followPollInterval = 250 * time.Millisecond
+
+// followInput is an Input that reads a file as it grows, like `tail -F`. It
+// detects when the file is truncated, or renamed and recreated, and carries on
+// with the new data. If it has a state file, it records the position of the
+// last delivered record there, so that a restarted rex resumes without
+// duplicating or skipping data.
+type followInput struct {
+	path    string
+	name    string
+	bufSize int
+	framing *record.Framing
+	state   *stateFile // nil if the read position is not persisted.
+
+	f      *os.File
+	ino    uint64 // Inode of the file being read.
+	offset int64  // Offset just past the last record read.
+}
+
+// newFollowInput opens the given file for following. If statePath is not
+// empty, it resumes from the position stored in the state file, provided the
+// state refers to the same file.
+func newFollowInput(path string, name string, bufSize int, framing *record.Framing, statePath string) (*followInput, error) {
+	in := &followInput{
+		path:    path,
+		name:    name,
+		bufSize: bufSize,
+		framing: framing,
+	}
+
+	err := in.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if statePath != "" {
+		in.state = newStateFile(statePath)
+
+		ino, offset, err := in.state.Load()
+		if err != nil {
+			in.f.Close()
+			return nil, err
+		}
+
+		err = in.resume(ino, offset)
+		if err != nil {
+			in.f.Close()
+			return nil, err
+		}
+	}
+
+	return in, nil
+}
+
+// open opens the followed path and starts reading it from the beginning.
+func (in *followInput) open() error {
+	f, err := os.Open(in.path)
+	if err != nil {
+		return err
+	}
+
+	ino, _, err := fileID(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	in.f = f
+	in.ino = ino
+	in.offset = 0
+	return nil
+}
+
+// resume seeks to the given offset if the followed file is the one the offset
+// refers to. Otherwise, the file was replaced while rex was not running, so
+// reading starts from the beginning.
+func (in *followInput) resume(ino uint64, offset int64) error {
+	_, size, err := fileID(in.f)
+	if err != nil {
+		return err
+	}
+
+	if ino != in.ino || offset > size {
+		return nil
+	}
+
+	_, err = in.f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	in.offset = offset
+	return nil
+}
+
+func (in *followInput) Read(ctx context.Context, recs chan<- *record.Record) error {
+	for {
+		fr := &followReader{
+			ctx: ctx,
+			in:  in,
+		}
+		rr := record.NewReader(fr, in.name, in.bufSize, in.framing)
+
+		for {
+			rec, err := rr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			// Don't count a delimiter that rex supplied.
+			in.offset += int64(rec.Size())
+			if rec.Unterminated {
+				in.offset -= int64(len(rec.Delim))
+			}
+			if in.state != nil {
+				ino, offset := in.ino, in.offset
+				rec.Ack = func() {
+					// On failure, the state stays dirty, so the
+					// error resurfaces when the state is flushed.
+					in.state.Save(ino, offset)
+				}
+			}
+
+			select {
+			case recs <- rec:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// The follow reader only reports EOF when the file has been
+		// truncated or replaced. Start over with the new data.
+		if fr.truncated {
+			_, err := in.f.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			in.offset = 0
+		} else {
+			in.f.Close()
+			err := in.open()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close saves the read position, if it is persisted, and closes the file.
+func (in *followInput) Close() error {
+	if in.state != nil {
+		err := in.state.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return in.f.Close()
+}
+
+// followReader implements io.Reader. It reads a followed file, waiting for
+// more data to be written rather than reporting EOF. It reports EOF only once
+// it has read all the data in a file that has since been truncated or
+// replaced.
+type followReader struct {
+	ctx       context.Context
+	in        *followInput
+	replaced  bool // The path refers to a different file than the one being read.
+	truncated bool // The file being read has been truncated.
+}
+
+func (fr *followReader) Read(b []byte) (int, error) {
+	for {
+		n, err := fr.in.f.Read(b)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+
+		// If the file was replaced, data may have been appended to the old
+		// file between the last read and the check that detected the
+		// replacement. The read above collected any such data.
+		if fr.replaced {
+			return 0, io.EOF
+		}
+
+		err = fr.check()
+		if err != nil {
+			return 0, err
+		}
+		if fr.truncated {
+			return 0, io.EOF
+		}
+		if fr.replaced {
+			continue
+		}
+
+		select {
+		case <-time.After(followPollInterval):
+		case <-fr.ctx.Done():
+			return 0, fr.ctx.Err()
+		}
+	}
+}
+
+// check determines whether the followed file has been truncated or replaced.
+func (fr *followReader) check() error {
+	pos, err := fr.in.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, size, err := fileID(fr.in.f)
+	if err != nil {
+		return err
+	}
+	if size < pos {
+		fr.truncated = true
+		return nil
+	}
+
+	st, err := os.Stat(fr.in.path)
+	if err != nil {
+		// The file was renamed or removed, and has not been recreated yet.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if statIno(st) != fr.in.ino {
+		fr.replaced = true
+	}
+
+	return nil
+}
+
+// fileID returns the inode number and size of an open file.
+func fileID(f *os.File) (uint64, int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return statIno(st), st.Size(), nil
+}
+
+func statIno(st os.FileInfo) uint64 {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		panic(fmt.Sprintf("internal error: unexpected stat type: %T", st.Sys()))
+	}
+	return sys.Ino
+}
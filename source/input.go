@@ -0,0 +1,138 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/badvassal/rex/record"
+)
+
+// streamInput is an Input that reads from a single stream.
+type streamInput struct {
+	rr *record.Reader
+}
+
+// NewStreamInput creates an Input that reads records from r. Its records are
+// attributed to the named source. If framing is not nil, each record is a
+// frame of that framing, such as a line; otherwise, each is the data returned
+// by a single read.
+func NewStreamInput(r io.Reader, name string, bufSize int, framing *record.Framing) Input {
+	return &streamInput{
+		rr: record.NewReader(r, name, bufSize, framing),
+	}
+}
+
+func (in *streamInput) Read(ctx context.Context, recs chan<- *record.Record) error {
+	for {
+		rec, err := in.rr.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case recs <- rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fifoInput is an Input that reads from a named pipe. If it is persistent, it
+// outlives the fifo's writers: when the last writer closes the fifo, the input
+// reopens it and waits for the next writer rather than ending.
+type fifoInput struct {
+	path    string
+	name    string
+	bufSize int
+	framing *record.Framing
+	persist bool
+}
+
+func (in *fifoInput) Read(ctx context.Context, recs chan<- *record.Record) error {
+	for {
+		err := in.readOnce(ctx, recs)
+		if err != nil || !in.persist {
+			return err
+		}
+	}
+}
+
+// readOnce opens the fifo and reads from it until all writers have closed it.
+// Each open is a session of its own, and an unterminated record left by one
+// set of writers is terminated, so it is never joined with data from the
+// next.
+func (in *fifoInput) readOnce(ctx context.Context, recs chan<- *record.Record) error {
+	// Blocks until a writer opens the fifo.
+	f, err := os.Open(in.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return NewStreamInput(f, in.name, in.bufSize, in.framing).Read(ctx, recs)
+}
+
+// listenInput is an Input that accepts connections on a listening socket. It
+// reads from every connection in parallel. Each connection is a session of its
+// own, and its unterminated final record is terminated, so that records from
+// different connections are never joined together.
+type listenInput struct {
+	ln      net.Listener
+	name    string
+	bufSize int
+	framing *record.Framing
+}
+
+func (in *listenInput) Read(ctx context.Context, recs chan<- *record.Record) error {
+	// Unblock Accept() when the context is canceled.
+	go func() {
+		<-ctx.Done()
+		in.ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := in.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			// A failed connection only affects its own client; don't
+			// report it.
+			NewStreamInput(conn, in.name, in.bufSize, in.framing).Read(ctx, recs)
+		}()
+	}
+}
+
+// procInput is an Input that reads from a child process's stdout.
+type procInput struct {
+	Input
+	cmd *exec.Cmd
+}
+
+func (in *procInput) Read(ctx context.Context, recs chan<- *record.Record) error {
+	err := in.Input.Read(ctx, recs)
+
+	// Reap the child. Its exit status does not concern rex.
+	in.cmd.Wait()
+
+	return err
+}
@@ -0,0 +1,165 @@
+package source
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/badvassal/rex/record"
+)
+
+// Example source specifier string:
+// type=file,id=/var/log/syslog,name=syslog,follow
+
+type parser struct {
+	s       Source
+	keyVals map[string]string
+}
+
+// Parse parses the given source specifier string, returning the resulting
+// Source on success, error on failure.
+func Parse(s string) (*Source, error) {
+	p := parser{
+		s:       makeSource(),
+		keyVals: map[string]string{},
+	}
+
+	err := p.parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p.s, nil
+}
+
+// parse parses the given source specifier string, writing the result to the
+// parser's internal source field. It returns an error on parse failure.
+func (p *parser) parse(s string) error {
+	fail := func(err error) error {
+		return fmt.Errorf("invalid source: source=[%s]: %w", s, err)
+	}
+
+	// Source fields are separated by commas.
+	fields := strings.Split(s, ",")
+
+	for _, t := range fields {
+		err := p.parseField(t)
+		if err != nil {
+			return fail(fmt.Errorf("parse failure: field=[%s]: %w", t, err))
+		}
+	}
+
+	if p.s.Type == unsetType {
+		return fmt.Errorf("missing 'type' field")
+	}
+
+	if p.s.ID == "" {
+		return fmt.Errorf("missing 'id' field")
+	}
+
+	if p.s.State != "" && !p.s.Follow {
+		return fmt.Errorf("'state' field requires 'follow'")
+	}
+
+	// Unless the user names the source, refer to it by its ID.
+	if p.s.Name == "" {
+		p.s.Name = p.s.ID
+	}
+
+	return nil
+}
+
+// parseField parses a single source specifier field. On success, it
+// populates the parser's internal source struct accordingly.
+func (p *parser) parseField(field string) error {
+	var err error
+
+	// Some fields have `k=v` notation, others have `x`. Determine which type
+	// of field this is by checking for the presence of an `=` character.
+	parts := strings.SplitN(field, "=", 2)
+	if len(parts) == 2 {
+		err = p.parseKeyVal(parts[0], parts[1])
+	} else {
+		err = p.parseStandalone(field)
+	}
+	return err
+}
+
+func (p *parser) parseKeyVal(k string, v string) error {
+	// Don't allow the same key to be specified twice in a source specifier
+	// string.
+	if p.keyVals[k] == "" {
+		p.keyVals[k] = v
+	} else if p.keyVals[k] != v {
+		return fmt.Errorf("duplicate keyval: key=%s val1=%s val2=%s", k, p.keyVals[k], v)
+	}
+
+	switch k {
+	case "type":
+		st, ok := nameTypeMap[v]
+		if !ok {
+			return fmt.Errorf("unrecognized type: %s", v)
+		}
+		p.s.Type = st
+		return nil
+
+	case "id":
+		p.s.ID = v
+		return nil
+
+	case "name":
+		p.s.Name = v
+		return nil
+
+	case "state":
+		p.s.State = v
+		return nil
+
+	case "perm":
+		perm, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", k, err)
+		}
+		p.s.Perm = uint32(perm)
+		return nil
+
+	case "framing":
+		f, err := record.ParseFraming(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", k, err)
+		}
+		p.s.Framing = f
+		return nil
+
+	case "args":
+		allArgs := strings.TrimSpace(v)
+		p.s.Args = strings.Fields(allArgs)
+		return nil
+
+	default:
+		return fmt.Errorf("unrecognized key: %s", k)
+	}
+}
+
+func (p *parser) parseStandalone(field string) error {
+	switch field {
+	case "follow":
+		p.s.Follow = true
+		return nil
+
+	case "lines":
+		p.s.Framing = record.LineFraming()
+		return nil
+
+	case "create":
+		p.s.Create = true
+		return nil
+
+	case "persist":
+		p.s.Persist = true
+		return nil
+
+	default:
+		return fmt.Errorf("unrecognized field")
+	}
+}
@@ -0,0 +1,231 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/badvassal/rex/record"
+	"golang.org/x/sys/unix"
+)
+
+// Type specifies the broad category of the source.
+type Type int
+
+const (
+	TypeFD     Type = iota // File descriptor
+	TypeFile               // File
+	TypeFifo               // Named pipe
+	TypeListen             // Listening socket
+	TypeProc               // Child process
+)
+
+const (
+	unsetType = Type(-1) // Not a valid type.
+
+	defaultPerm = 0644
+)
+
+var typeNames = []string{
+	TypeFD:     "fd",
+	TypeFile:   "file",
+	TypeFifo:   "fifo",
+	TypeListen: "listen",
+	TypeProc:   "proc",
+}
+
+var nameTypeMap = map[string]Type{}
+
+func init() {
+	for st, name := range typeNames {
+		nameTypeMap[name] = Type(st)
+	}
+}
+
+// Source is a fully self-contained description of a data source. Use the Open
+// method to acquire a corresponding Input for the Source.
+type Source struct {
+	Type    Type
+	ID      string
+	Name    string
+	Args    []string
+	Follow  bool
+	Framing *record.Framing // How the input is split into records; nil for none.
+	State   string          // Path of the file that persists a followed file's position.
+	Perm    uint32
+	Create  bool
+	Persist bool
+}
+
+// Stdin is the Source rex reads from when no other inputs are specified.
+func Stdin() *Source {
+	return &Source{
+		Type: TypeFD,
+		ID:   "0",
+		Name: "stdin",
+	}
+}
+
+// makeSource builds a default-initialized Source struct. The result is not
+// usable for reading data, but it is a suitable initial state for parsing a
+// source specifier string.
+func makeSource() Source {
+	return Source{
+		Type: unsetType,
+		Perm: defaultPerm,
+	}
+}
+
+// Input produces records from an opened Source.
+type Input interface {
+	// Read sends the input's records to recs until the input is exhausted,
+	// an error occurs, or ctx is canceled.
+	Read(ctx context.Context, recs chan<- *record.Record) error
+}
+
+// Open builds an input associated with the receiver Source struct. The
+// input's behavior is specified by the Source's fields. bufSize is the size of
+// the buffer used to read from the source; it also limits the length of a
+// line.
+func (s *Source) Open(bufSize int) (Input, error) {
+	switch s.Type {
+	case TypeFD:
+		return s.openFD(bufSize)
+
+	case TypeFile:
+		return s.openFile(bufSize)
+
+	case TypeFifo:
+		return s.openFifo(bufSize)
+
+	case TypeListen:
+		return s.openListen(bufSize)
+
+	case TypeProc:
+		return s.openProc(bufSize)
+
+	default:
+		panic(fmt.Sprintf("internal error: invalid source type: %v", s.Type))
+	}
+}
+
+// openFD creates an input for a Source whose type is TypeFD.
+func (s *Source) openFD(bufSize int) (Input, error) {
+	fd, err := strconv.Atoi(s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor has invalid id: have=%s want=<number>: %w", s.ID, err)
+	}
+
+	f := os.NewFile(uintptr(fd), s.Name)
+	return NewStreamInput(f, s.Name, bufSize, s.Framing), nil
+}
+
+// openFile creates an input for a Source whose type is TypeFile.
+func (s *Source) openFile(bufSize int) (Input, error) {
+	if s.Follow {
+		return newFollowInput(s.ID, s.Name, bufSize, s.Framing, s.State)
+	}
+
+	f, err := os.Open(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStreamInput(f, s.Name, bufSize, s.Framing), nil
+}
+
+// openFifo creates an input for a Source whose type is TypeFifo. Opening a
+// fifo for reading blocks until a writer appears, so the fifo is not actually
+// opened until the input is read.
+func (s *Source) openFifo(bufSize int) (Input, error) {
+	if s.Create {
+		err := unix.Mkfifo(s.ID, s.Perm)
+		if err != nil && err != syscall.EEXIST {
+			return nil, err
+		}
+	}
+
+	// Frame a persistent fifo, by lines unless the source says otherwise,
+	// so that the data of one set of writers is never joined with the
+	// next's.
+	framing := s.Framing
+	if framing == nil && s.Persist {
+		framing = record.LineFraming()
+	}
+
+	return &fifoInput{
+		path:    s.ID,
+		name:    s.Name,
+		bufSize: bufSize,
+		framing: framing,
+		persist: s.Persist,
+	}, nil
+}
+
+// openListen creates an input for a Source whose type is TypeListen. The
+// source's ID is a URL of the form tcp://[host]:port or unix:///path.
+func (s *Source) openListen(bufSize int) (Input, error) {
+	u, err := url.Parse(s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("listen address has invalid id: have=%s want=<url>: %w", s.ID, err)
+	}
+
+	var addr string
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		addr = u.Host
+
+	case "unix":
+		addr = u.Path
+
+	default:
+		return nil, fmt.Errorf("listen address has invalid scheme: have=%s want=tcp|tcp4|tcp6|unix", u.Scheme)
+	}
+
+	ln, err := net.Listen(u.Scheme, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frame each connection, by lines unless the source says otherwise, so
+	// that records from different connections are never joined together.
+	framing := s.Framing
+	if framing == nil {
+		framing = record.LineFraming()
+	}
+
+	return &listenInput{
+		ln:      ln,
+		name:    s.Name,
+		bufSize: bufSize,
+		framing: framing,
+	}, nil
+}
+
+// openProc creates an input for a Source whose type is TypeProc. The input
+// reads the child's stdout; the child's stderr goes to rex's stderr.
+func (s *Source) openProc(bufSize int) (Input, error) {
+	cmd := exec.Command(s.ID, s.Args...)
+
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &procInput{
+		Input: NewStreamInput(r, s.Name, bufSize, s.Framing),
+		cmd:   cmd,
+	}, nil
+}
@@ -0,0 +1,99 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval is the minimum time between writes of a state file. The
+// latest state is always written when the file is flushed.
+const stateSaveInterval = time.Second
+
+// stateFile persists the read position of a followed file. The file contains
+// the inode number of the followed file and the offset just past the last
+// record delivered from it.
+type stateFile struct {
+	sync.Mutex
+	path   string
+	ino    uint64
+	offset int64
+	dirty  bool      // The latest state has not been written yet.
+	saved  time.Time // When the state was last written.
+}
+
+func newStateFile(path string) *stateFile {
+	return &stateFile{
+		path: path,
+	}
+}
+
+// Load reads the state file. If the file does not exist, it reports an offset
+// of zero for inode zero, which never matches a real file.
+func (sf *stateFile) Load() (uint64, int64, error) {
+	b, err := os.ReadFile(sf.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	var ino uint64
+	var offset int64
+	_, err = fmt.Sscanf(string(b), "%d %d\n", &ino, &offset)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid state file: path=%s: %w", sf.path, err)
+	}
+
+	return ino, offset, nil
+}
+
+// Save records the given position. To keep the cost of following a busy file
+// down, the state file is written at most once per stateSaveInterval.
+func (sf *stateFile) Save(ino uint64, offset int64) error {
+	sf.Lock()
+	defer sf.Unlock()
+
+	sf.ino = ino
+	sf.offset = offset
+	sf.dirty = true
+
+	if time.Since(sf.saved) < stateSaveInterval {
+		return nil
+	}
+	return sf.write()
+}
+
+// Flush writes the latest recorded position if it hasn't been written yet.
+func (sf *stateFile) Flush() error {
+	sf.Lock()
+	defer sf.Unlock()
+
+	if !sf.dirty {
+		return nil
+	}
+	return sf.write()
+}
+
+// write replaces the state file's contents. It writes to a temporary file
+// first so that a crash never leaves a partially written state file behind.
+func (sf *stateFile) write() error {
+	tmp := sf.path + ".tmp"
+
+	err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", sf.ino, sf.offset)), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, sf.path)
+	if err != nil {
+		return err
+	}
+
+	sf.dirty = false
+	sf.saved = time.Now()
+	return nil
+}
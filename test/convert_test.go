@@ -0,0 +1,38 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// Structured records are rendered in each destination's output format, and
+// other records are written unchanged.
+func TestConvert(t *testing.T) {
+	lhs := []string{
+		`{"level":"error","msg":"disk full","n":3,"http":{"status":500}}`,
+		`level=info msg="hello world" ok`,
+		`GET / 200`,
+	}
+
+	out, err := testutil.WriteLines([]string{"type=fd,id=1,outformat=logfmt"}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, `level=error msg="disk full" n=3 http="{\"status\":500}"`+"\n"+
+		`level=info msg="hello world" ok=true`+"\n"+
+		lhs[2]+"\n", out)
+
+	out, err = testutil.WriteLines([]string{"type=fd,id=1,outformat=json"}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, lhs[0]+"\n"+
+		`{"level":"info","msg":"hello world","ok":true}`+"\n"+
+		lhs[2]+"\n", out)
+
+	out, err = testutil.WriteLines([]string{`type=fd,id=1,outformat=csv:level\,http.status\,msg`}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, "error,500,disk full\ninfo,,hello world\n"+lhs[2]+"\n", out)
+
+	out, err = testutil.WriteLines([]string{`type=fd,id=1,outformat=template:[{{.level}}] {{.msg}}`}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, "[error] disk full\n[info] hello world\n"+lhs[2]+"\n", out)
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+func tempFileFilename() string {
+	return testutil.TempFilename("rextest-file-")
+}
+
+// Child's stdout and stderr are passed through and routed by stream.
+func TestExecStreams(t *testing.T) {
+	outFilename := tempFileFilename()
+	errFilename := tempFileFilename()
+	defer os.Remove(outFilename)
+	defer os.Remove(errFilename)
+
+	args := []string{
+		"exec",
+		fmt.Sprintf("type=file,id=%s,create,stream=stdout", outFilename),
+		fmt.Sprintf("type=file,id=%s,create,stream=stderr", errFilename),
+		"--", "sh", "-c", "echo out; echo err >&2",
+	}
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	stdout, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	stderr, err := io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, err)
+
+	err = rexCmd.Cmd.Wait()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "out\n", string(stdout))
+	assert.Equal(t, "err\n", string(stderr))
+
+	b, err := os.ReadFile(outFilename)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(b))
+
+	b, err = os.ReadFile(errFilename)
+	assert.NoError(t, err)
+	assert.Equal(t, "err\n", string(b))
+}
+
+// A partial line, such as a prompt, is passed through without waiting for
+// the rest of the line.
+func TestExecPrompt(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{"exec", "--", "sh", "-c", "printf 'name? '; read name; echo hi $name"})
+	assert.NoError(t, err)
+
+	prompt := make([]byte, 6)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(rexCmd.Stdout, prompt)
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		assert.NoError(t, err)
+		assert.Equal(t, "name? ", string(prompt))
+	case <-time.After(2 * time.Second):
+		t.Fatal("prompt not passed through")
+	}
+
+	_, err = rexCmd.Stdin.Write([]byte("bob\n"))
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	rest, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi bob\n", string(rest))
+	assert.NoError(t, rexCmd.Cmd.Wait())
+}
+
+// rex exits with the child's exit status.
+func TestExecStatus(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{"exec", "--", "sh", "-c", "exit 3"})
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	io.ReadAll(rexCmd.Stdout)
+	io.ReadAll(rexCmd.Stderr)
+
+	err = rexCmd.Cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	assert.True(t, ok)
+	assert.Equal(t, 3, exitErr.ExitCode())
+}
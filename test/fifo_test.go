@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/badvassal/rex/test/testutil"
 	"github.com/tj/assert"
@@ -119,8 +124,282 @@ func TestFifoNonblocking(t *testing.T) {
 	assert.NoError(t, err)
 	rexCmd.Stdin.Close()
 
+	// Don't read until rex has finished writing. Otherwise, reading frees
+	// space in the fifo for data that should have been discarded.
+	err = rexCmd.Cmd.Wait()
+	assert.NoError(t, err)
+
 	// Ensure first 16KB is readable and rest was discarded.
 	rhs, err := io.ReadAll(f)
 	assert.NoError(t, err)
 	assert.Equal(t, lhs[:bufSize], rhs)
 }
+
+// Persistent fifo input survives its writers coming and going.
+func TestFifoSourcePersist(t *testing.T) {
+	filename := tempFifoFilename()
+	args := []string{
+		"-i", fmt.Sprintf("type=fifo,id=%s,create,persist", filename),
+		"type=fd,id=1",
+	}
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	lines := lineChan(rexCmd.Stdout)
+
+	err = testutil.Wait1SForFile(filename)
+	assert.NoError(t, err)
+
+	for _, s := range []string{"one", "two", "three"} {
+		f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		assert.NoError(t, err)
+		_, err = f.WriteString(s + "\n")
+		assert.NoError(t, err)
+		f.Close()
+
+		expectLines(t, lines, s)
+	}
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+}
+
+// A persistent fifo source terminates a line that a writer leaves
+// unterminated, rather than joining it with the next writer's data.
+func TestFifoSourcePersistUnterminated(t *testing.T) {
+	filename := tempFifoFilename()
+	args := []string{
+		"-i", fmt.Sprintf("type=fifo,id=%s,create,persist", filename),
+		"type=fd,id=1",
+	}
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	lines := lineChan(rexCmd.Stdout)
+
+	err = testutil.Wait1SForFile(filename)
+	assert.NoError(t, err)
+
+	for _, s := range []string{"AAA", "BBB"} {
+		f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		assert.NoError(t, err)
+		_, err = f.WriteString(s)
+		assert.NoError(t, err)
+		f.Close()
+
+		expectLines(t, lines, s)
+	}
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+}
+
+// One fifo,nonblocking,records=line; overflow discards whole lines only.
+func TestFifoNonblockingRecords(t *testing.T) {
+	filename := tempFifoFilename()
+	bufSize := 16 * testutil.KB
+	args := []string{
+		"-b", "1000",
+		fmt.Sprintf("type=fifo,id=%s,create,nonblocking,bufsize=%d,records=line", filename, bufSize),
+	}
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	f, err := testutil.Wait1SForFileThenOpen(filename)
+	assert.NoError(t, err)
+
+	// Lines of varying length, so that read boundaries split them.
+	var lhs []string
+	for i := 0; i < 1000; i++ {
+		lhs = append(lhs, testutil.RandString(50+i%250))
+	}
+
+	_, err = rexCmd.Stdin.Write([]byte(strings.Join(lhs, "\n") + "\n"))
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	err = rexCmd.Cmd.Wait()
+	assert.NoError(t, err)
+
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	rhs := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+
+	// Every line that arrived must be a complete input line, in order.
+	assert.True(t, len(rhs) > 0)
+	var i int
+	for _, line := range rhs {
+		for i < len(lhs) && lhs[i] != line {
+			i++
+		}
+		assert.True(t, i < len(lhs), "fragmented line: %s", line)
+	}
+}
+
+// One fifo,nonblocking,marker,seq; each marker accounts for a gap in the
+// sequence numbers.
+func TestFifoNonblockingMarker(t *testing.T) {
+	filename := tempFifoFilename()
+	args := []string{
+		fmt.Sprintf("type=fifo,id=%s,create,nonblocking,bufsize=%d,records=line,marker=text,seq", filename, 16*testutil.KB),
+	}
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	f, err := testutil.Wait1SForFileThenOpen(filename)
+	assert.NoError(t, err)
+
+	// Read slowly, so that rex has to discard data.
+	var rhs []byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4*testutil.KB)
+		for {
+			n, err := f.Read(buf)
+			rhs = append(rhs, buf[:n]...)
+			if err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var lhs []string
+	for i := 0; i < 10000; i++ {
+		lhs = append(lhs, testutil.RandString(100))
+	}
+	_, err = rexCmd.Stdin.Write([]byte(strings.Join(lhs, "\n") + "\n"))
+	assert.NoError(t, err)
+
+	// Once the reader catches up, a final line forces out the marker.
+	time.Sleep(500 * time.Millisecond)
+	_, err = rexCmd.Stdin.Write([]byte("last\n"))
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	err = rexCmd.Cmd.Wait()
+	assert.NoError(t, err)
+	<-done
+
+	markerRE := regexp.MustCompile(`^\[rex: dropped (\d+) bytes / (\d+) lines\]$`)
+	var markers int
+	var prevSeq int
+	var gap int
+	for _, line := range strings.Split(strings.TrimSuffix(string(rhs), "\n"), "\n") {
+		if m := markerRE.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			gap += n
+			markers++
+			continue
+		}
+
+		var seq int
+		_, err := fmt.Sscanf(line, "%d ", &seq)
+		assert.NoError(t, err)
+		assert.Equal(t, prevSeq+gap+1, seq)
+		prevSeq = seq
+		gap = 0
+	}
+
+	assert.True(t, markers > 0)
+	assert.Equal(t, len(lhs)+1, prevSeq)
+}
+
+// A fifo that nobody reads doesn't hold up a fast destination once its write
+// timeout elapses.
+func TestFifoTimeout(t *testing.T) {
+	filename := tempFifoFilename()
+	rexCmd, err := testutil.StartRex([]string{
+		"type=fd,id=1",
+		fmt.Sprintf("type=fifo,id=%s,create,bufsize=%d,timeout=200ms", filename, 16*testutil.KB),
+	})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+		rexCmd.Stdin.Close()
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		rhs, _ := io.ReadAll(rexCmd.Stdout)
+		done <- rhs
+	}()
+
+	select {
+	case rhs := <-done:
+		assert.Equal(t, lhs, rhs)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("fast destination was held up by stalled fifo")
+	}
+
+	stderr, err := io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+	assert.Contains(t, string(stderr), "degraded")
+}
+
+// A reconnecting fifo only delivers data written while a reader is attached,
+// and survives its reader going away.
+func TestFifoReconnect(t *testing.T) {
+	filename := tempFifoFilename()
+	rexCmd, err := testutil.StartRex([]string{
+		fmt.Sprintf("type=fifo,id=%s,create,reconnect,nonblocking,records=line", filename),
+	})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.NoError(t, testutil.Wait1SForFile(filename))
+
+	// Attaches a reader, then writes a line for it to read.
+	attach := func(line string) *os.File {
+		opened := make(chan *os.File)
+		go func() {
+			f, err := os.Open(filename)
+			assert.NoError(t, err)
+			opened <- f
+		}()
+
+		// Give the reader time to start opening the fifo.
+		time.Sleep(100 * time.Millisecond)
+		_, err := rexCmd.Stdin.Write([]byte(line + "\n"))
+		assert.NoError(t, err)
+
+		f := <-opened
+		b := make([]byte, len(line)+1)
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, line+"\n", string(b))
+		return f
+	}
+
+	// Nobody is reading yet.
+	_, err = rexCmd.Stdin.Write([]byte("stale\n"))
+	assert.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+
+	f := attach("live")
+	f.Close()
+
+	// The reader is gone.
+	_, err = rexCmd.Stdin.Write([]byte("gone\n"))
+	assert.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+
+	f = attach("again")
+	defer f.Close()
+
+	rexCmd.Stdin.Close()
+	assert.NoError(t, rexCmd.Cmd.Wait())
+}
@@ -0,0 +1,33 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// Each destination receives only the lines that pass its filters.
+func TestFilter(t *testing.T) {
+	lhs := []string{
+		"INFO starting",
+		"WARN disk low",
+		"ERROR disk full",
+		"ERROR GET /healthz failed",
+		"INFO done",
+	}
+
+	out, err := testutil.WriteLines([]string{
+		`type=fd,id=1,include=^WARN,include=^ERROR,exclude=/healthz`,
+	}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, "WARN disk low\nERROR disk full\n", out)
+
+	// A comma in a regular expression is escaped.
+	out, err = testutil.WriteLines([]string{
+		`type=fd,id=1,exclude=^[A-Z]{4\,5} disk`,
+	}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{lhs[0], lhs[3], lhs[4]}, "\n")+"\n", out)
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// lineChan continuously reads lines from r and sends them to the returned
+// channel.
+func lineChan(r io.Reader) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			ch <- s.Text()
+		}
+	}()
+	return ch
+}
+
+func expectLines(t *testing.T, ch <-chan string, lines ...string) {
+	for _, exp := range lines {
+		select {
+		case line := <-ch:
+			assert.Equal(t, exp, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line: %s", exp)
+		}
+	}
+}
+
+func appendFile(t *testing.T, filename string, s string) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(s)
+	assert.NoError(t, err)
+}
+
+// Followed file is appended to, rotated, and truncated.
+func TestFollowRotate(t *testing.T) {
+	filename := tempFileFilename()
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".1")
+
+	appendFile(t, filename, "one\n")
+
+	rexCmd, err := testutil.StartRex([]string{
+		"-i", fmt.Sprintf("type=file,id=%s,follow", filename),
+		"type=fd,id=1",
+	})
+	assert.NoError(t, err)
+	lines := lineChan(rexCmd.Stdout)
+
+	expectLines(t, lines, "one")
+
+	appendFile(t, filename, "two\n")
+	expectLines(t, lines, "two")
+
+	// Rotate: data written to the old file after the rename still arrives.
+	err = os.Rename(filename, filename+".1")
+	assert.NoError(t, err)
+	appendFile(t, filename+".1", "three\n")
+	appendFile(t, filename, "four\n")
+	expectLines(t, lines, "three", "four")
+
+	// Truncate. Give rex a chance to notice before the file regrows.
+	err = os.Truncate(filename, 0)
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	appendFile(t, filename, "five\n")
+	expectLines(t, lines, "five")
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+}
+
+// Restarted rex resumes from the position in its state file.
+func TestFollowState(t *testing.T) {
+	filename := tempFileFilename()
+	stateFilename := tempFileFilename()
+	defer os.Remove(filename)
+	defer os.Remove(stateFilename)
+
+	args := []string{
+		"-i", fmt.Sprintf("type=file,id=%s,follow,state=%s", filename, stateFilename),
+		"type=fd,id=1",
+	}
+
+	appendFile(t, filename, "one\ntwo\n")
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	expectLines(t, lineChan(rexCmd.Stdout), "one", "two")
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+
+	appendFile(t, filename, "three\n")
+
+	rexCmd, err = testutil.StartRex(args)
+	assert.NoError(t, err)
+	expectLines(t, lineChan(rexCmd.Stdout), "three")
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+}
+
+// The state file only covers records that have left the destination's queue,
+// so records still queued when rex is stopped are read again on restart.
+func TestFollowStateQueued(t *testing.T) {
+	filename := tempFileFilename()
+	stateFilename := tempFileFilename()
+	defer os.Remove(filename)
+	defer os.Remove(stateFilename)
+
+	// Much more than the pipe to the stalled process can hold.
+	appendFile(t, filename, strings.Repeat("0123456789abcdef\n", 64*1024))
+
+	args := []string{
+		"-i", fmt.Sprintf("type=file,id=%s,follow,state=%s", filename, stateFilename),
+		"type=proc,id=sleep,args=5,queue=4MB",
+	}
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+
+	time.Sleep(time.Second)
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+
+	b, err := os.ReadFile(stateFilename)
+	assert.NoError(t, err)
+
+	var ino, offset int64
+	_, err = fmt.Sscanf(string(b), "%d %d\n", &ino, &offset)
+	assert.NoError(t, err)
+	assert.True(t, offset < 512*1024, "state covers undelivered records: offset=%d", offset)
+}
+
+// The state file doesn't cover lines that a multiline destination is still
+// assembling into a record, so they are read again on restart.
+func TestFollowStateMultiline(t *testing.T) {
+	filename := tempFileFilename()
+	stateFilename := tempFileFilename()
+	defer os.Remove(filename)
+	defer os.Remove(stateFilename)
+
+	args := []string{
+		"-i", fmt.Sprintf("type=file,id=%s,follow,state=%s", filename, stateFilename),
+		`type=fd,id=1,multiline.start=^\S`,
+	}
+
+	appendFile(t, filename, "one\n  more\n")
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+
+	// Nothing continues or ends the record before rex is stopped.
+	time.Sleep(500 * time.Millisecond)
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+
+	appendFile(t, filename, "two\n")
+
+	rexCmd, err = testutil.StartRex(args)
+	assert.NoError(t, err)
+	expectLines(t, lineChan(rexCmd.Stdout), "one", "  more")
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+}
+
+// The state file doesn't cover the start of a line that a framed destination
+// is still waiting to complete, so it is read again on restart, along with
+// whatever was read with it.
+func TestFollowStateFraming(t *testing.T) {
+	filename := tempFileFilename()
+	stateFilename := tempFileFilename()
+	defer os.Remove(filename)
+	defer os.Remove(stateFilename)
+
+	args := []string{
+		"-i", fmt.Sprintf("type=file,id=%s,follow,state=%s", filename, stateFilename),
+		"type=fd,id=1,records=line",
+	}
+
+	appendFile(t, filename, "one\ntw")
+
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	expectLines(t, lineChan(rexCmd.Stdout), "one")
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+
+	appendFile(t, filename, "o\n")
+
+	rexCmd, err = testutil.StartRex(args)
+	assert.NoError(t, err)
+	expectLines(t, lineChan(rexCmd.Stdout), "one", "two")
+
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// u32beFrames frames each message with its length as a big-endian uint32.
+func u32beFrames(msgs ...[]byte) []byte {
+	var b []byte
+	for _, m := range msgs {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(m)))
+		b = append(b, m...)
+	}
+	return b
+}
+
+// Length-prefixed records are filtered whole, and a length-prefixed input is
+// passed byte for byte to outputs without a framing.
+func TestFramingLength(t *testing.T) {
+	stdin := "type=fd,id=0,framing=u32be-length"
+
+	msgs := [][]byte{
+		[]byte("hello"),
+		{},
+		[]byte("bin\n\x00ary"),
+		bytes.Repeat([]byte("x"), 100*1024),
+		[]byte("bye"),
+	}
+	data := u32beFrames(msgs...)
+
+	out, err := testutil.WriteBytes([]string{"-i", stdin, "type=fd,id=1,framing=u32be-length,include=ary|bye"}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, u32beFrames(msgs[2], msgs[4]), out)
+
+	filename := tempFileFilename()
+	defer os.Remove(filename)
+	err = os.WriteFile(filename, data, 0644)
+	assert.NoError(t, err)
+
+	out, err = testutil.WriteBytes([]string{
+		"-i", fmt.Sprintf("type=file,id=%s,framing=u32be-length", filename),
+		"type=fd,id=1",
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	// Each varint-prefixed message becomes a record.
+	var varint []byte
+	for _, m := range msgs[:3] {
+		varint = binary.AppendUvarint(varint, uint64(len(m)))
+		varint = append(varint, m...)
+	}
+	out, err = testutil.WriteBytes([]string{
+		"-i", "type=fd,id=0,framing=varint-length",
+		"type=fd,id=1,framing=varint-length,exclude=hello",
+	}, varint)
+	assert.NoError(t, err)
+	assert.Equal(t, varint[6:], out)
+}
+
+// Delimited and fixed-size records are written whole.
+func TestFramingDelim(t *testing.T) {
+	out, err := testutil.WriteBytes([]string{`type=fd,id=1,framing=delim:\r\n,seq`}, []byte("a\r\nb\nc\r\nd"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1 a\r\n2 b\nc\r\n3 d", string(out))
+
+	out, err = testutil.WriteBytes([]string{"type=fd,id=1,framing=nul,exclude=^b"}, []byte("a\x00b\x00c\x00"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a\x00c\x00", string(out))
+
+	out, err = testutil.WriteBytes([]string{"type=fd,id=1,framing=fixed:3,sample=1/2"}, []byte("abcdefghijk"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcghi", string(out))
+}
+
+// Records are re-encoded with the output's framing, and unframed input is
+// divided into lines before it is given length prefixes.
+func TestFramingEncode(t *testing.T) {
+	out, err := testutil.WriteBytes([]string{"type=fd,id=1,framing=u32be-length"}, []byte("ab\ncd"))
+	assert.NoError(t, err)
+	assert.Equal(t, u32beFrames([]byte("ab"), []byte("cd")), out)
+
+	out, err = testutil.WriteBytes([]string{
+		"-i", "type=fd,id=0,framing=nul",
+		"type=fd,id=1,framing=lines",
+	}, []byte("a\x00b\x00c"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\nc\n", string(out))
+
+	out, err = testutil.WriteBytes([]string{
+		"-i", "type=fd,id=0,framing=u32be-length",
+		"type=fd,id=1,framing=fixed:2",
+	}, u32beFrames([]byte("abc"), []byte("d")))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(out))
+
+	// Fixed-size records have no delimiter or prefix of their own, but are
+	// records all the same.
+	fixed := []string{"-i", "type=fd,id=0,framing=fixed:4"}
+	out, err = testutil.WriteBytes(append(fixed, "type=fd,id=1,framing=lines"), []byte("abcdefgh"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd\nefgh\n", string(out))
+
+	out, err = testutil.WriteBytes(append(fixed, "type=fd,id=1,framing=u32be-length"), []byte("abcdefgh"))
+	assert.NoError(t, err)
+	assert.Equal(t, u32beFrames([]byte("abcd"), []byte("efgh")), out)
+}
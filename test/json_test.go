@@ -0,0 +1,62 @@
+package test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// Each line is wrapped in a JSON envelope with its metadata and static
+// fields.
+func TestJSONEnvelope(t *testing.T) {
+	lhs := []string{`say "hi"`, "tab\there", "bad \xff byte"}
+	out, err := testutil.WriteLines([]string{
+		"type=fd,id=1,format=json,field.env=prod,field.team=web",
+	}, lhs)
+	assert.NoError(t, err)
+
+	host, err := os.Hostname()
+	assert.NoError(t, err)
+
+	rhs := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	assert.Equal(t, len(lhs), len(rhs))
+
+	var instance string
+	for i, line := range rhs {
+		var env map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(line), &env), line)
+
+		assert.Equal(t, host, env["host"])
+		assert.Equal(t, "stdin", env["source"])
+		assert.Equal(t, float64(i+1), env["seq"])
+		assert.Equal(t, "prod", env["env"])
+		assert.Equal(t, "web", env["team"])
+
+		tm, err := time.Parse(time.RFC3339Nano, env["time"].(string))
+		assert.NoError(t, err)
+		assert.True(t, time.Since(tm) < time.Minute)
+
+		if i == 0 {
+			instance = env["instance"].(string)
+			assert.NotEqual(t, "", instance)
+		}
+		assert.Equal(t, instance, env["instance"])
+
+		// Invalid UTF-8 is replaced in line, and preserved in line_base64.
+		if i == 2 {
+			assert.Equal(t, "bad � byte", env["line"])
+			raw, err := base64.StdEncoding.DecodeString(env["line_base64"].(string))
+			assert.NoError(t, err)
+			assert.Equal(t, lhs[i], string(raw))
+		} else {
+			assert.Equal(t, lhs[i], env["line"])
+			assert.NotContains(t, env, "line_base64")
+		}
+	}
+}
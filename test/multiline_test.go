@@ -0,0 +1,98 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+var stackTrace = []string{
+	"INFO starting",
+	"ERROR request failed",
+	"java.lang.NullPointerException",
+	"    at Foo.bar(Foo.java:10)",
+	"    at Foo.main(Foo.java:3)",
+	"INFO done",
+}
+
+// Continuation lines are folded into one record before filtering.
+func TestMultiline(t *testing.T) {
+	out, err := testutil.WriteLines([]string{
+		`type=fd,id=1,multiline.start=^[A-Z]+ ,include=^ERROR,seq`,
+	}, stackTrace)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 "+strings.Join(stackTrace[1:5], "\n")+"\n", out)
+
+	out, err = testutil.WriteLines([]string{
+		`type=fd,id=1,multiline.continue=^\s,multiline.maxlines=2,seq`,
+	}, stackTrace)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"1 INFO starting",
+		"2 ERROR request failed",
+		"3 java.lang.NullPointerException",
+		stackTrace[3],
+		"4 " + stackTrace[4],
+		"5 INFO done",
+	}, "\n")+"\n", out)
+}
+
+// The global multiline flags apply to every destination without multiline
+// settings of its own.
+func TestMultilineFlags(t *testing.T) {
+	filename := tempFileFilename()
+	defer os.Remove(filename)
+
+	out, err := testutil.WriteLines([]string{
+		"-multiline.continue", `^\s`,
+		"type=fd,id=1,seq",
+		fmt.Sprintf("type=file,id=%s,create,multiline.start=^INFO,seq", filename),
+	}, stackTrace)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"1 INFO starting",
+		"2 ERROR request failed",
+		"3 java.lang.NullPointerException",
+		stackTrace[3],
+		stackTrace[4],
+		"4 INFO done",
+	}, "\n")+"\n", out)
+
+	b, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 "+strings.Join(stackTrace[:5], "\n")+"\n2 INFO done\n", string(b))
+}
+
+// The global multiline flags, like the option, require a delimited framing.
+func TestMultilineFlagsFraming(t *testing.T) {
+	_, err := testutil.WriteLines([]string{
+		"-multiline.continue", `^\s`,
+		"type=fd,id=1,framing=u32be-length",
+	}, stackTrace)
+	assert.Error(t, err)
+}
+
+// A record is written once no line has continued it for the timeout.
+func TestMultilineTimeout(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		`type=fd,id=1,multiline.continue=^\s,multiline.timeout=100ms`,
+	})
+	assert.NoError(t, err)
+
+	_, err = rexCmd.Stdin.Write([]byte("first\n  more\n"))
+	assert.NoError(t, err)
+
+	// The record arrives while the input is still open.
+	buf := make([]byte, len("first\n  more\n"))
+	_, err = io.ReadFull(rexCmd.Stdout, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n  more\n", string(buf))
+
+	rexCmd.Stdin.Close()
+	assert.NoError(t, rexCmd.Cmd.Wait())
+}
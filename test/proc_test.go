@@ -0,0 +1,237 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// A stalled nonblocking process doesn't hold up a fast destination, even
+// without a queue.
+func TestProcNonblocking(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"type=fd,id=1",
+		"type=proc,id=sleep,args=5,nonblocking,bufsize=16384",
+	})
+	assert.NoError(t, err)
+	defer rexCmd.Cmd.Wait()
+	defer rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+	}()
+
+	// The child inherits rex's stdout, so rex's output doesn't end while the
+	// child lives.
+	done := make(chan []byte)
+	go func() {
+		rhs := make([]byte, len(lhs))
+		io.ReadFull(rexCmd.Stdout, rhs)
+		done <- rhs
+	}()
+
+	select {
+	case rhs := <-done:
+		assert.Equal(t, lhs, rhs)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("fast destination was held up by nonblocking process")
+	}
+}
+
+// A failed optional process is detached, and rex carries on writing to the
+// other destinations.
+func TestProcOptional(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"type=fd,id=1",
+		"type=proc,id=true,optional",
+	})
+	assert.NoError(t, err)
+
+	// Let the child exit before writing, so that writing to it fails.
+	time.Sleep(200 * time.Millisecond)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+		rexCmd.Stdin.Close()
+	}()
+
+	rhs, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	stderr, err := io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.Equal(t, lhs, rhs)
+	assert.Contains(t, string(stderr), "detaching")
+}
+
+// A group fails over from a failed process to the next member.
+func TestProcFailover(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"type=proc,id=true,group=g,priority=1",
+		"type=fd,id=1,group=g,priority=2",
+	})
+	assert.NoError(t, err)
+
+	// Let the child exit before writing, so that writing to it fails.
+	time.Sleep(200 * time.Millisecond)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+		rexCmd.Stdin.Close()
+	}()
+
+	rhs, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	stderr, err := io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.Equal(t, lhs, rhs)
+	assert.Contains(t, string(stderr), "switched to dest fd:1")
+}
+
+// A group whose primary can't be started starts on the next member.
+func TestProcFailoverOpen(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"type=proc,id=/nonexistent/rex-test,group=g,priority=1",
+		"type=fd,id=1,group=g,priority=2",
+	})
+	assert.NoError(t, err)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+		rexCmd.Stdin.Close()
+	}()
+
+	rhs, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	stderr, err := io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.Equal(t, lhs, rhs)
+	assert.Contains(t, string(stderr), "switched to dest fd:1")
+}
+
+// A failing process behind a circuit breaker doesn't fail rex; its circuit
+// opens instead.
+func TestProcBreaker(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"type=fd,id=1",
+		"type=proc,id=true,breaker=1,probe=1m",
+	})
+	assert.NoError(t, err)
+
+	// Let the child exit before writing, so that writing to it fails.
+	time.Sleep(200 * time.Millisecond)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+		rexCmd.Stdin.Close()
+	}()
+
+	rhs, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	stderr, err := io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.Equal(t, lhs, rhs)
+	assert.Contains(t, string(stderr), "circuit closed -> open")
+}
+
+// A process that a circuit breaker reopens is reaped once it exits.
+func TestProcBreakerReap(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"type=proc,id=true,breaker=1000,probe=1m",
+	})
+	assert.NoError(t, err)
+
+	// Each write finds the last process gone, fails, and starts another.
+	for i := 0; i < 20; i++ {
+		time.Sleep(20 * time.Millisecond)
+		rexCmd.Stdin.Write([]byte("line\n"))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, 0, zombies(t, rexCmd.Cmd.Process.Pid))
+
+	rexCmd.Stdin.Close()
+	io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+}
+
+// A process destination with a queue, a spill directory and a timeout
+// releases them each time its breaker reopens it.
+func TestProcBreakerReopen(t *testing.T) {
+	spillDir, err := os.MkdirTemp("", "rextest-spill-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	rexCmd, err := testutil.StartRex([]string{
+		fmt.Sprintf("type=proc,id=true,breaker=1000,probe=1m,spill=%s,timeout=1s", spillDir),
+	})
+	assert.NoError(t, err)
+
+	flap := func(n int) int {
+		for i := 0; i < n; i++ {
+			time.Sleep(20 * time.Millisecond)
+			rexCmd.Stdin.Write([]byte("line\n"))
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", rexCmd.Cmd.Process.Pid))
+		assert.NoError(t, err)
+		return len(fds)
+	}
+
+	before := flap(5)
+	after := flap(20)
+	assert.True(t, after <= before+2, "fds: before=%d after=%d", before, after)
+
+	rexCmd.Stdin.Close()
+	io.ReadAll(rexCmd.Stderr)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+}
+
+// zombies returns the number of children of the given process that have
+// exited but have not been reaped.
+func zombies(t *testing.T, pid int) int {
+	tasks, err := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", pid))
+	assert.NoError(t, err)
+
+	var n int
+	for _, task := range tasks {
+		b, err := os.ReadFile(task)
+		assert.NoError(t, err)
+
+		for _, child := range strings.Fields(string(b)) {
+			stat, err := os.ReadFile(fmt.Sprintf("/proc/%s/stat", child))
+			if err != nil {
+				continue
+			}
+
+			// The state follows the parenthesized command name.
+			i := strings.LastIndexByte(string(stat), ')')
+			if i >= 0 && strings.HasPrefix(string(stat[i+1:]), " Z") {
+				n++
+			}
+		}
+	}
+
+	return n
+}
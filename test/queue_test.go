@@ -0,0 +1,212 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// A stalled destination doesn't hold up a fast one until its queue is full.
+func TestQueueDecoupled(t *testing.T) {
+	rexCmd, err := testutil.StartRex([]string{
+		"-q", "4MB",
+		"type=fd,id=1",
+		"type=proc,id=sleep,args=5",
+	})
+	assert.NoError(t, err)
+	defer rexCmd.Cmd.Wait()
+	defer rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	go func() {
+		rexCmd.Stdin.Write(lhs)
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		rhs := make([]byte, len(lhs))
+		io.ReadFull(rexCmd.Stdout, rhs)
+		done <- rhs
+	}()
+
+	select {
+	case rhs := <-done:
+		assert.Equal(t, lhs, rhs)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("fast destination was held up by slow one")
+	}
+}
+
+// A stalled fifo with overflow=drop-oldest keeps the newest lines.
+func TestQueueDropOldest(t *testing.T) {
+	filename := tempFifoFilename()
+	rexCmd, err := testutil.StartRex([]string{
+		fmt.Sprintf("type=fifo,id=%s,create,bufsize=%d,overflow=drop-oldest,queue=16K,records=line", filename, 16*testutil.KB),
+	})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	f, err := testutil.Wait1SForFileThenOpen(filename)
+	assert.NoError(t, err)
+
+	var lhs []string
+	for i := 0; i < 1000; i++ {
+		lhs = append(lhs, testutil.RandString(100))
+	}
+	_, err = rexCmd.Stdin.Write([]byte(strings.Join(lhs, "\n") + "\n"))
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	// Give rex time to fill the fifo and its queue before reading.
+	time.Sleep(500 * time.Millisecond)
+
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	rhs := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.True(t, len(rhs) < len(lhs))
+	assert.True(t, isSubsequence(rhs, lhs))
+	assert.Equal(t, lhs[len(lhs)-1], rhs[len(rhs)-1])
+}
+
+// isSubsequence reports whether every element of sub appears in seq, in the
+// same order.
+func isSubsequence(sub []string, seq []string) bool {
+	var i int
+	for _, s := range sub {
+		for i < len(seq) && seq[i] != s {
+			i++
+		}
+		if i == len(seq) {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// A stalled fifo with a spill directory loses nothing, and the directory is
+// emptied once everything has been delivered.
+func TestQueueSpill(t *testing.T) {
+	filename := tempFifoFilename()
+	spillDir, err := os.MkdirTemp("", "rextest-spill-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	rexCmd, err := testutil.StartRex([]string{
+		fmt.Sprintf("type=fifo,id=%s,create,bufsize=%d,queue=16K,spill=%s,records=line", filename, 16*testutil.KB, spillDir),
+	})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	f, err := testutil.Wait1SForFileThenOpen(filename)
+	assert.NoError(t, err)
+
+	var lhs []string
+	for i := 0; i < 1000; i++ {
+		lhs = append(lhs, testutil.RandString(100))
+	}
+	_, err = rexCmd.Stdin.Write([]byte(strings.Join(lhs, "\n") + "\n"))
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	// Give rex time to fill the fifo and its queue before reading.
+	time.Sleep(500 * time.Millisecond)
+
+	segs, err := filepath.Glob(filepath.Join(spillDir, "*.seg"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, segs)
+
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	rhs := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.Equal(t, lhs, rhs)
+
+	segs, err = filepath.Glob(filepath.Join(spillDir, "*.seg"))
+	assert.NoError(t, err)
+	assert.Empty(t, segs)
+}
+
+// Data that a failed destination never received is written by the next rex
+// to use the spill directory.
+func TestQueueSpillRestart(t *testing.T) {
+	spillDir, err := os.MkdirTemp("", "rextest-spill-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	// The child exits without reading, so every write fails.
+	rexCmd, err := testutil.StartRex([]string{
+		fmt.Sprintf("type=proc,id=true,spill=%s", spillDir),
+	})
+	assert.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	rexCmd.Stdin.Write(lhs)
+	rexCmd.Stdin.Close()
+	io.ReadAll(rexCmd.Stderr)
+	assert.Error(t, rexCmd.Cmd.Wait())
+
+	rexCmd, err = testutil.StartRex([]string{
+		fmt.Sprintf("type=fd,id=1,spill=%s", spillDir),
+	})
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	rhs, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	assert.NotEmpty(t, rhs)
+	assert.Equal(t, lhs[:len(rhs)], rhs)
+}
+
+// Data still queued in memory when rex is stopped by a signal is written by
+// the next rex to use the spill directory.
+func TestQueueSpillSignal(t *testing.T) {
+	spillDir, err := os.MkdirTemp("", "rextest-spill-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	// The child never reads, so everything beyond the pipe's capacity stays
+	// in the queue.
+	rexCmd, err := testutil.StartRex([]string{
+		fmt.Sprintf("type=proc,id=sleep,args=5,queue=4MB,spill=%s", spillDir),
+	})
+	assert.NoError(t, err)
+
+	lhs := testutil.RandBytes(testutil.MB)
+	rexCmd.Stdin.Write(lhs)
+
+	time.Sleep(500 * time.Millisecond)
+	rexCmd.Cmd.Process.Signal(syscall.SIGTERM)
+	rexCmd.Cmd.Wait()
+
+	rexCmd, err = testutil.StartRex([]string{
+		fmt.Sprintf("type=fd,id=1,spill=%s", spillDir),
+	})
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	rhs, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+	assert.NoError(t, rexCmd.Cmd.Wait())
+
+	// The child received the start of the data; the rest was saved.
+	assert.True(t, len(rhs) > len(lhs)/2, "saved %d bytes of %d", len(rhs), len(lhs))
+	assert.Equal(t, lhs[len(lhs)-len(rhs):], rhs)
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// A rate-limited destination discards what exceeds its rate, while the other
+// destinations get everything.
+func TestRateDrop(t *testing.T) {
+	filename := tempFileFilename()
+	defer os.Remove(filename)
+
+	var lhs []string
+	for i := 0; i < 1000; i++ {
+		lhs = append(lhs, testutil.RandString(20))
+	}
+
+	out, err := testutil.WriteLines([]string{
+		"type=fd,id=1",
+		fmt.Sprintf("type=file,id=%s,create,records=line,linerate=100/s", filename),
+	}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(lhs, "\n")+"\n", out)
+
+	b, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	rhs := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+
+	assert.True(t, len(rhs) >= 100)
+	assert.True(t, len(rhs) < 500)
+	assert.True(t, isSubsequence(rhs, lhs))
+}
+
+// A rate-limited destination that delays data delivers all of it, no faster
+// than its rate.
+func TestRateDelay(t *testing.T) {
+	var lhs []string
+	for i := 0; i < 300; i++ {
+		lhs = append(lhs, testutil.RandString(20))
+	}
+
+	start := time.Now()
+	out, err := testutil.WriteLines([]string{
+		"type=fd,id=1,records=line,linerate=200/s,limit=delay",
+	}, lhs)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join(lhs, "\n")+"\n", out)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
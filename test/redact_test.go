@@ -0,0 +1,65 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// Redaction replaces matches, or their first group, with a mask.
+func TestRedactMask(t *testing.T) {
+	out, err := testutil.WriteLines([]string{
+		`type=fd,id=1,redact=[0-9]{4}-[0-9]{4},redact=token=(\S+)`,
+	}, []string{
+		"card 1234-5678 token=abc def",
+		"nothing here",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "card [REDACTED] token=[REDACTED] def\nnothing here\n", out)
+}
+
+// Named patterns from a redaction file are masked with their names, or
+// replaced with keyed HMACs that are equal for equal values.
+func TestRedactFile(t *testing.T) {
+	rules := tempFileFilename()
+	defer os.Remove(rules)
+	err := os.WriteFile(rules, []byte("# Sensitive content.\n\nemail [a-z]+@[a-z]+\\.com\nbearer (?i)bearer (\\S+)\n"), 0644)
+	assert.NoError(t, err)
+
+	lhs := []string{
+		"from ann@example.com Bearer xyz",
+		"from bob@example.com",
+		"from ann@example.com",
+	}
+
+	out, err := testutil.WriteLines([]string{
+		fmt.Sprintf("type=fd,id=1,redactfile=%s", rules),
+	}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, "from [REDACTED:email] Bearer [REDACTED:bearer]\nfrom [REDACTED:email]\nfrom [REDACTED:email]\n", out)
+
+	key := tempFileFilename()
+	defer os.Remove(key)
+	err = os.WriteFile(key, []byte("secret\n"), 0600)
+	assert.NoError(t, err)
+
+	out, err = testutil.WriteLines([]string{
+		fmt.Sprintf("type=fd,id=1,redactfile=%s,redactkey=%s", rules, key),
+	}, lhs)
+	assert.NoError(t, err)
+	assert.NotContains(t, out, "example.com")
+	assert.NotContains(t, out, "xyz")
+
+	re := regexp.MustCompile(`\[email:[0-9a-f]{16}\]`)
+	rhs := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	assert.Equal(t, 3, len(rhs))
+	ann := re.FindString(rhs[0])
+	assert.NotEqual(t, "", ann)
+	assert.Equal(t, ann, re.FindString(rhs[2]))
+	assert.NotEqual(t, ann, re.FindString(rhs[1]))
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// One-in-N sampling forwards every Nth line, starting with the first.
+func TestSampleEvery(t *testing.T) {
+	var lhs []string
+	for i := 0; i < 1000; i++ {
+		lhs = append(lhs, testutil.RandString(20))
+	}
+
+	out, err := testutil.WriteLines([]string{"type=fd,id=1,sample=1/10"}, lhs)
+	assert.NoError(t, err)
+	rhs := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+
+	assert.Equal(t, 100, len(rhs))
+	for i, line := range rhs {
+		assert.Equal(t, lhs[i*10], line)
+	}
+}
+
+// Head sampling forwards the first lines of each period.
+func TestSampleFirst(t *testing.T) {
+	var lhs []string
+	for i := 0; i < 1000; i++ {
+		lhs = append(lhs, testutil.RandString(20))
+	}
+
+	out, err := testutil.WriteLines([]string{"type=fd,id=1,sample=first:5/min"}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(lhs[:5], "\n")+"\n", out)
+}
+
+// Keyed sampling forwards all of a key's lines or none of them.
+func TestSampleKey(t *testing.T) {
+	var lhs []string
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i%50)
+		lhs = append(lhs, fmt.Sprintf("%s %s", key, testutil.RandString(20)))
+		counts[key]++
+	}
+
+	out, err := testutil.WriteLines([]string{`type=fd,id=1,sample=30%,samplekey=^(k\d+) `}, lhs)
+	assert.NoError(t, err)
+	rhs := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+
+	assert.True(t, isSubsequence(rhs, lhs))
+
+	outCounts := map[string]int{}
+	for _, line := range rhs {
+		key, _, _ := strings.Cut(line, " ")
+		outCounts[key]++
+	}
+	assert.True(t, len(outCounts) > 0)
+	assert.True(t, len(outCounts) < 50)
+	for key, n := range outCounts {
+		assert.Equal(t, counts[key], n)
+	}
+}
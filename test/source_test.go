@@ -0,0 +1,94 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// writeTempLines writes numLines random lines to a new temp file, returning
+// the file's name and its lines.
+func writeTempLines(t *testing.T, numLines int, lineLen int) (string, []string) {
+	filename := tempFileFilename()
+
+	var lines []string
+	for i := 0; i < numLines; i++ {
+		lines = append(lines, testutil.RandString(lineLen))
+	}
+
+	err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	assert.NoError(t, err)
+
+	return filename, lines
+}
+
+func runRexStdout(t *testing.T, args []string) string {
+	rexCmd, err := testutil.StartRex(args)
+	assert.NoError(t, err)
+	rexCmd.Stdin.Close()
+
+	b, err := io.ReadAll(rexCmd.Stdout)
+	assert.NoError(t, err)
+
+	err = rexCmd.Cmd.Wait()
+	assert.NoError(t, err)
+
+	return string(b)
+}
+
+func sortedLines(s string) []string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+// Two file inputs merged into stdout; lines are never spliced.
+func TestSourceMerge(t *testing.T) {
+	filename1, lines1 := writeTempLines(t, 1000, 100)
+	filename2, lines2 := writeTempLines(t, 1000, 150)
+	defer os.Remove(filename1)
+	defer os.Remove(filename2)
+
+	out := runRexStdout(t, []string{
+		"-b", "1000",
+		"-i", fmt.Sprintf("type=file,id=%s", filename1),
+		"-i", fmt.Sprintf("type=file,id=%s", filename2),
+		"type=fd,id=1",
+	})
+
+	exp := append(append([]string{}, lines1...), lines2...)
+	sort.Strings(exp)
+	assert.Equal(t, exp, sortedLines(out))
+}
+
+// Destination only receives data from the named input.
+func TestSourceStream(t *testing.T) {
+	filename1, lines1 := writeTempLines(t, 100, 10)
+	filename2, _ := writeTempLines(t, 100, 10)
+	defer os.Remove(filename1)
+	defer os.Remove(filename2)
+
+	out := runRexStdout(t, []string{
+		"-i", fmt.Sprintf("type=file,id=%s,name=one", filename1),
+		"-i", fmt.Sprintf("type=file,id=%s,name=two", filename2),
+		"type=fd,id=1,stream=one",
+	})
+
+	assert.Equal(t, strings.Join(lines1, "\n")+"\n", out)
+}
+
+// Input from a child process.
+func TestSourceProc(t *testing.T) {
+	out := runRexStdout(t, []string{
+		"-i", "type=proc,id=echo,args=hello world",
+		"type=fd,id=1",
+	})
+
+	assert.Equal(t, "hello world\n", out)
+}
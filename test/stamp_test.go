@@ -0,0 +1,57 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// Each line is prefixed with its timestamp and tag, and every destination
+// stamps a line with the same time.
+func TestStamp(t *testing.T) {
+	filename := tempFileFilename()
+	defer os.Remove(filename)
+
+	lhs := []string{"one", "two", "three"}
+	out, err := testutil.WriteLines([]string{
+		"type=fd,id=1,timestamp=rfc3339nano,prefix=[web]",
+		fmt.Sprintf("type=file,id=%s,create,timestamp=rfc3339nano", filename),
+	}, lhs)
+	assert.NoError(t, err)
+
+	b, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+
+	outLines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	fileLines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	assert.Equal(t, len(lhs), len(outLines))
+	assert.Equal(t, len(lhs), len(fileLines))
+
+	for i, line := range lhs {
+		ts, rest, ok := strings.Cut(outLines[i], " ")
+		assert.True(t, ok)
+		assert.Equal(t, "[web] "+line, rest)
+		assert.Equal(t, ts+" "+line, fileLines[i])
+
+		tm, err := time.Parse(time.RFC3339Nano, ts)
+		assert.NoError(t, err)
+		assert.True(t, time.Since(tm) < time.Minute)
+	}
+}
+
+// Monotonic timestamps count seconds since rex started.
+func TestStampMono(t *testing.T) {
+	out, err := testutil.WriteLines([]string{
+		"type=fd,id=1,timestamp=mono,seq",
+	}, []string{"a", "b"})
+	assert.NoError(t, err)
+
+	re := regexp.MustCompile(`^[0-9]+\.[0-9]{6} 1 a\n[0-9]+\.[0-9]{6} 2 b\n$`)
+	assert.True(t, re.MatchString(out), out)
+}
@@ -3,6 +3,7 @@ package testutil
 import (
 	"io"
 	"os/exec"
+	"strings"
 )
 
 type RexCmd struct {
@@ -42,3 +43,36 @@ func StartRex(args []string) (*RexCmd, error) {
 		Stderr: stderr,
 	}, nil
 }
+
+// WriteBytes runs rex with the given arguments, feeds it the given data, and
+// returns its stdout.
+func WriteBytes(args []string, data []byte) ([]byte, error) {
+	rexCmd, err := StartRex(args)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		rexCmd.Stdin.Write(data)
+		rexCmd.Stdin.Close()
+	}()
+
+	b, err := io.ReadAll(rexCmd.Stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rexCmd.Cmd.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// WriteLines runs rex with the given arguments, feeds it the given lines, and
+// returns its stdout.
+func WriteLines(args []string, lines []string) (string, error) {
+	b, err := WriteBytes(args, []byte(strings.Join(lines, "\n")+"\n"))
+	return string(b), err
+}
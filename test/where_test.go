@@ -0,0 +1,57 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/badvassal/rex/test/testutil"
+	"github.com/tj/assert"
+)
+
+// Each destination receives the JSON records whose fields satisfy its
+// conditions, and the invalid destination receives the rest.
+func TestWhere(t *testing.T) {
+	lhs := []string{
+		`{"level":"error","service":"api","http":{"status":500}}`,
+		`{"level":"info","service":"auth","http":{"status":200}}`,
+		`not json`,
+		`{"level":"error","service":"web","http":{"status":"500"}}`,
+		`{"level":"error"} trailing`,
+	}
+
+	invalid := tempFileFilename()
+	defer os.Remove(invalid)
+
+	out, err := testutil.WriteLines([]string{
+		fmt.Sprintf(`type=fd,id=1,where=.level==error,where=.service in [api web],invalid=%s`, invalid),
+		fmt.Sprintf("type=file,id=%s,create", invalid),
+	}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, lhs[0]+"\n"+lhs[3]+"\n", out)
+
+	b, err := os.ReadFile(invalid)
+	assert.NoError(t, err)
+	assert.Equal(t, lhs[2]+"\n"+lhs[4]+"\n", string(b))
+
+	// Quoted values only equal strings; bare numbers equal both.
+	out, err = testutil.WriteLines([]string{`type=fd,id=1,where=.http.status=="500"`}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, lhs[3]+"\n", out)
+
+	out, err = testutil.WriteLines([]string{`type=fd,id=1,where=.http.status!=500`}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, lhs[1]+"\n", out)
+
+	out, err = testutil.WriteLines([]string{`type=fd,id=1,where=.service not in [api\,auth]`}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, lhs[3]+"\n", out)
+	// Commas in a list don't separate fields.
+	out, err = testutil.WriteLines([]string{`type=fd,id=1,where=.service in [api,auth],seq`}, lhs)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 "+lhs[0]+"\n2 "+lhs[1]+"\n", out)
+
+	// The invalid output must exist.
+	_, err = testutil.WriteLines([]string{`type=fd,id=1,where=.level==error,invalid=nowhere.log`}, lhs)
+	assert.Error(t, err)
+}